@@ -0,0 +1,24 @@
+package httphandler
+
+import "mime"
+
+// SetDetectAttachments sets whether the responses with the "Content-Disposition: attachment" header
+// are marked as Attachment, with the suggested file name recorded as AttachmentFilename,
+// to tell downloadable files from inline content. The attachments are counted in the batch summary.
+func (h *HTTPHandler) SetDetectAttachments(enabled bool) {
+	h.detectAttachments = enabled
+}
+
+// detectAttachment marks the response if its Content-Disposition header makes it an attachment.
+func (h *HTTPHandler) detectAttachment(r *Response) {
+	if !h.detectAttachments {
+		return
+	}
+	disposition, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" {
+		return
+	}
+	r.Attachment = true
+	// The extended filename* parameter is decoded into filename.
+	r.AttachmentFilename = params["filename"]
+}
@@ -0,0 +1,52 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerDetectAttachments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/report":
+			w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+		case "/encoded":
+			w.Header().Set("Content-Disposition", `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`)
+		case "/inline":
+			w.Header().Set("Content-Disposition", `inline; filename="page.html"`)
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetDetectAttachments(true)
+	body := srv.URL + "/report\n" + srv.URL + "/encoded\n" + srv.URL + "/inline\n" + srv.URL + "/plain\n"
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path       string
+		attachment bool
+		filename   string
+	}{
+		{path: "/report", attachment: true, filename: "report.pdf"},
+		{path: "/encoded", attachment: true, filename: "résumé.txt"},
+		{path: "/inline"},
+		{path: "/plain"},
+	} {
+		resp := resps.Map[srv.URL+tt.path]
+		if resp.Attachment != tt.attachment || resp.AttachmentFilename != tt.filename || resp.Size != int64(len("content")) {
+			t.Errorf("attachments test: %s: got attachment %v filename %q size %d, want attachment %v filename %q",
+				tt.path, resp.Attachment, resp.AttachmentFilename, resp.Size, tt.attachment, tt.filename)
+		}
+	}
+	if n := resps.Summary().Attachments; n != 2 {
+		t.Errorf("attachments test: got %d attachments in the summary want 2", n)
+	}
+}
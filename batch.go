@@ -0,0 +1,189 @@
+package httphandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchConfig contains the options of a single batch, overriding the handler configuration.
+type batchConfig struct {
+	// timeout is the timeout of each request in the batch. Zero means the handler timeout.
+	timeout time.Duration
+	// method is the HTTP method of each request in the batch.
+	method string
+	// host overrides the Host header of each request in the batch, if not empty.
+	host string
+	// header is the header forwarded from the batch request to each request, or nil.
+	header http.Header
+	// jar is the cookie jar shared by the requests of the batch, or nil.
+	jar http.CookieJar
+}
+
+// batch is the state of a single batch shared by its requests.
+type batch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    batchConfig
+	resps  *ResponseMap
+	wg     sync.WaitGroup
+	// budget throttles the retries of the batch, or is nil if they are not throttled.
+	budget *retryBudget
+
+	mu  sync.Mutex
+	err error
+}
+
+// newBatch creates a batch cancelled together with the parent context.
+func newBatch(parent context.Context, cfg batchConfig) *batch {
+	ctx, cancel := context.WithCancel(parent)
+	return &batch{
+		ctx:    ctx,
+		cancel: cancel,
+		cfg:    cfg,
+		resps:  NewResponseMap(),
+	}
+}
+
+// abort cancels the requests of the batch. The first reason is kept.
+func (b *batch) abort(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cancel()
+}
+
+// abortErr returns the reason the batch was aborted, or nil.
+func (b *batch) abortErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// batchMethods is the set of methods that can be used for the requests.
+var batchMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// urlSource yields the URLs of a batch one by one, like bufio.Scanner.
+type urlSource interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// listSource yields the URLs from a list.
+type listSource struct {
+	urls []string
+	next int
+}
+
+func (ls *listSource) Scan() bool {
+	if ls.next >= len(ls.urls) {
+		return false
+	}
+	ls.next++
+	return true
+}
+
+func (ls *listSource) Text() string {
+	return ls.urls[ls.next-1]
+}
+
+func (ls *listSource) Err() error {
+	return nil
+}
+
+// TimeoutHeader is the request header overriding the timeout of each request in the batch, e.g. "5s".
+// The timeout option of the query or the body takes precedence over it.
+const TimeoutHeader = "X-Request-Timeout"
+
+// headerTimeout returns the request timeout set with the batch request header,
+// or zero if it is absent or invalid, so that the handler timeout applies.
+func headerTimeout(r *http.Request) time.Duration {
+	timeout, err := time.ParseDuration(r.Header.Get(TimeoutHeader))
+	if err != nil || timeout <= 0 {
+		return 0
+	}
+	return timeout
+}
+
+// isQueryBatch reports whether the batch is listed in the query of a GET request.
+func isQueryBatch(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Query().Has("url")
+}
+
+// parseQueryBatch reads the batch from the query parameters: repeated url parameters
+// and the optional timeout, method and host shared by all the URLs, e.g.
+// ?url=http://a.com&url=http://b.com&timeout=5s&method=HEAD. The host overrides the Host header
+// of the requests, e.g. to request a virtual host on a known address.
+// The options not set in the query are taken from cfg.
+func parseQueryBatch(query url.Values, cfg batchConfig) (_ batchConfig, urls urlSource, err error) {
+	for name, values := range query {
+		if name == "url" {
+			continue
+		}
+		if len(values) != 1 {
+			return cfg, nil, fmt.Errorf("parameter %s must be set once", name)
+		}
+		if err = cfg.set(name, values[0]); err != nil {
+			return cfg, nil, err
+		}
+	}
+	return cfg, &listSource{urls: query["url"]}, nil
+}
+
+// parseBodyOptions parses the options line of the request body, a JSON object with the same options
+// as the query parameters of a GET batch, e.g. {"timeout":"5s","method":"HEAD"}.
+func parseBodyOptions(line string, cfg *batchConfig) error {
+	var options map[string]string
+	if err := json.Unmarshal([]byte(line), &options); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	for name, value := range options {
+		if err := cfg.set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set applies a single option to the batch configuration.
+func (cfg *batchConfig) set(name, value string) (err error) {
+	switch name {
+	case "timeout":
+		cfg.timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if cfg.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %s", value)
+		}
+	case "method":
+		if !batchMethods[value] {
+			return fmt.Errorf("unsupported method %s", value)
+		}
+		cfg.method = value
+	case "host":
+		if value == "" || strings.ContainsAny(value, " \t\r\n/") {
+			return fmt.Errorf("invalid host %q", value)
+		}
+		cfg.host = value
+	default:
+		return fmt.Errorf("unknown parameter %s", name)
+	}
+	return nil
+}
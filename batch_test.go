@@ -0,0 +1,279 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerQueryBatch(t *testing.T) {
+	var mu sync.Mutex
+	methods := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods[r.URL.Path] = r.Method
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("query batch"))
+	}))
+	defer srv.Close()
+
+	query := url.Values{
+		"url":     {srv.URL + "/a", srv.URL + "/b", srv.URL + "/slow"},
+		"timeout": {"100ms"},
+		"method":  {http.MethodHead},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	NewHTTPHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusMultiStatus {
+		t.Errorf("query batch test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusMultiStatus)
+	}
+	param := TestParams{RespSizes: []int{-1, 11, 11}}
+	if sizes, valid := param.IsResponseBodyValid(rr.Body); !valid {
+		t.Errorf("query batch test: handler returned unexpected body: got %v want %v", sizes, param.RespSizes)
+	}
+	mu.Lock()
+	for path, method := range methods {
+		if method != http.MethodHead {
+			t.Errorf("query batch test: %s requested with %s want %s", path, method, http.MethodHead)
+		}
+	}
+	mu.Unlock()
+
+	for _, invalid := range []string{
+		"url=" + url.QueryEscape(srv.URL) + "&timeout=abc",
+		"url=" + url.QueryEscape(srv.URL) + "&method=CONNECT",
+		"url=" + url.QueryEscape(srv.URL) + "&unknown=1",
+		"url=invalidurl",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+invalid, nil)
+		rr := httptest.NewRecorder()
+		NewHTTPHandler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("query batch test: %s: handler returned wrong status code: got %v want %v", invalid, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHTTPHandlerBodyOptions(t *testing.T) {
+	var mu sync.Mutex
+	methods := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods[r.URL.Path] = r.Method
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("body options"))
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	body := `{"timeout":"100ms","method":"HEAD"}` + "\n" + srv.URL + "/a\n" + srv.URL + "/slow\n"
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMultiStatus {
+		t.Errorf("body options test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusMultiStatus)
+	}
+	mu.Lock()
+	for path, method := range methods {
+		if method != http.MethodHead {
+			t.Errorf("body options test: %s requested with %s want %s", path, method, http.MethodHead)
+		}
+	}
+	mu.Unlock()
+
+	// The options only apply to their batch.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/slow"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("body options test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	mu.Lock()
+	if methods["/slow"] != http.MethodGet {
+		t.Errorf("body options test: /slow requested with %s want %s", methods["/slow"], http.MethodGet)
+	}
+	mu.Unlock()
+
+	for _, invalid := range []string{
+		`{"timeout":` + "\n" + srv.URL,
+		`{"timeout":5}` + "\n" + srv.URL,
+		`{"method":"CONNECT"}` + "\n" + srv.URL,
+		`{"unknown":"1"}` + "\n" + srv.URL,
+		`{"host":"a.com/path"}` + "\n" + srv.URL,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(invalid))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("body options test: %q: handler returned wrong status code: got %v want %v", invalid, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHTTPHandlerTimeoutHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetMaxRequestTimeout(500 * time.Millisecond)
+	for _, tt := range []struct {
+		header   string
+		options  string
+		respCode int
+	}{
+		{header: "100ms", respCode: http.StatusMultiStatus},
+		// An invalid header falls back to the handler timeout.
+		{header: "soon", respCode: http.StatusOK},
+		{header: "2s", respCode: http.StatusBadRequest},
+		{options: `{"timeout":"2s"}`, respCode: http.StatusBadRequest},
+		// The body option takes precedence over the header.
+		{header: "100ms", options: `{"timeout":"400ms"}`, respCode: http.StatusOK},
+	} {
+		body := srv.URL + "/a\n" + srv.URL + "/slow"
+		if tt.options != "" {
+			body = tt.options + "\n" + body
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if tt.header != "" {
+			req.Header.Set(TimeoutHeader, tt.header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("timeout header test: header %q and options %q: got status %d want %d", tt.header, tt.options, rr.Code, tt.respCode)
+		}
+	}
+}
+
+func TestHTTPHandlerHostOverride(t *testing.T) {
+	hosts := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	body := `{"host":"api.example.com"}` + "\n" + srv.URL
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("host override test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if host := <-hosts; host != "api.example.com" {
+		t.Errorf("host override test: upstream received Host %q want %q", host, "api.example.com")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/?host=api.example.com&url="+url.QueryEscape(srv.URL), nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if host := <-hosts; host != "api.example.com" {
+		t.Errorf("host override test: query batch upstream received Host %q want %q", host, "api.example.com")
+	}
+}
+
+func TestHTTPHandlerMethod(t *testing.T) {
+	methods := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		w.Write([]byte("handler method"))
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		method  string
+		options string
+		want    string
+	}{
+		{method: http.MethodHead, want: http.MethodHead},
+		{method: http.MethodPost, want: http.MethodPost},
+		{method: http.MethodHead, options: `{"method":"GET"}` + "\n", want: http.MethodGet},
+	} {
+		handler := NewHTTPHandler()
+		if err := handler.SetMethod(tt.method); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.options+srv.URL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method := <-methods; method != tt.want {
+			t.Errorf("method test %s: upstream received %s want %s", tt.method, method, tt.want)
+		}
+		// The size of HEAD responses is taken from Content-Length.
+		if size := resps.Map[srv.URL].Size; size != int64(len("handler method")) {
+			t.Errorf("method test %s: got size %d want %d", tt.method, size, len("handler method"))
+		}
+	}
+
+	if err := NewHTTPHandler().SetMethod("CONNECT"); err == nil {
+		t.Error("method test: unsupported method unexpectedly accepted")
+	}
+}
+
+func TestParseQueryBatch(t *testing.T) {
+	cfg, urls, err := parseQueryBatch(url.Values{"url": {"http://a.com", "http://b.com"}}, batchConfig{method: http.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.method != http.MethodGet || cfg.timeout != 0 {
+		t.Errorf("query parse test: got %+v want defaults", cfg)
+	}
+	var got []string
+	for urls.Scan() {
+		got = append(got, urls.Text())
+	}
+	if strings.Join(got, " ") != "http://a.com http://b.com" {
+		t.Errorf("query parse test: got URLs %v", got)
+	}
+}
+
+func TestHTTPHandlerMaxServerErrors(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	const n = 10
+	var urls []string
+	for i := 0; i < n; i++ {
+		urls = append(urls, srv.URL+"/"+strconv.Itoa(i))
+	}
+	handler := NewHTTPHandler()
+	handler.SetGlobalWorkerCount(1)
+	defer handler.SetGlobalWorkerCount(0)
+	handler.SetMaxServerErrors(2)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Join(urls, "\n")))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("server errors test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadGateway)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits >= n {
+		t.Errorf("server errors test: batch was not aborted, %d URLs fetched", hits)
+	}
+}
@@ -0,0 +1,87 @@
+package httphandler
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of a buffer used to read a response body.
+const copyBufferSize = 32 * 1024
+
+// bufferPool hands out the buffers used to read response bodies.
+// If the pool is bounded, the total size of the buffers in use never exceeds its budget
+// and callers wait for a buffer to be returned.
+type bufferPool struct {
+	pool  sync.Pool
+	slots chan struct{}
+
+	mu       sync.Mutex
+	inUse    int64
+	maxInUse int64
+}
+
+// newBufferPool creates a pool limited by the memory budget in bytes.
+// The budget is rounded down to the buffer size, but at least one buffer is always available.
+// Zero or negative budget creates an unbounded pool.
+func newBufferPool(budget int64) *bufferPool {
+	bp := &bufferPool{
+		pool: sync.Pool{New: func() interface{} {
+			buf := make([]byte, copyBufferSize)
+			return &buf
+		}},
+	}
+	if budget > 0 {
+		n := budget / copyBufferSize
+		if n < 1 {
+			n = 1
+		}
+		bp.slots = make(chan struct{}, n)
+	}
+	return bp
+}
+
+// get returns a buffer, waiting for one to be returned to the pool if the budget is exhausted.
+func (bp *bufferPool) get(ctx context.Context) (*[]byte, error) {
+	if bp.slots != nil {
+		select {
+		case bp.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	buf := bp.pool.Get().(*[]byte)
+	bp.mu.Lock()
+	bp.inUse += int64(len(*buf))
+	if bp.inUse > bp.maxInUse {
+		bp.maxInUse = bp.inUse
+	}
+	bp.mu.Unlock()
+	return buf, nil
+}
+
+// put returns the buffer to the pool.
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.mu.Lock()
+	bp.inUse -= int64(len(*buf))
+	bp.mu.Unlock()
+	bp.pool.Put(buf)
+	if bp.slots != nil {
+		<-bp.slots
+	}
+}
+
+// discard reads r until EOF using buf and returns the number of bytes read.
+// Unlike io.CopyBuffer into io.Discard, it always reads through the provided buffer.
+func discard(r io.Reader, buf []byte) (n int64, err error) {
+	for {
+		nr, rerr := r.Read(buf)
+		n += int64(nr)
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
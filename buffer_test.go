@@ -0,0 +1,139 @@
+package httphandler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerCopyMemoryBudget(t *testing.T) {
+	const budget = 2 * copyBufferSize
+	content := bytes.Repeat([]byte{'x'}, 4*copyBufferSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	handler.SetCopyMemoryBudget(budget)
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(buf, "%s/%d\n", srv.URL, i)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", buf)
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for url, resp := range resps.Map {
+		if resp.Error != nil || resp.Size != int64(len(content)) {
+			t.Errorf("memory budget test: %s: got size %d, error %v want size %d", url, resp.Size, resp.Error, len(content))
+		}
+	}
+	if handler.buffers.maxInUse > budget {
+		t.Errorf("memory budget test: %d bytes of buffers in use, budget is %d", handler.buffers.maxInUse, budget)
+	}
+	if handler.buffers.inUse != 0 {
+		t.Errorf("memory budget test: %d bytes of buffers were not returned", handler.buffers.inUse)
+	}
+}
+
+func TestBufferPoolMinimumBudget(t *testing.T) {
+	if bp := newBufferPool(1); cap(bp.slots) != 1 {
+		t.Errorf("buffer pool test: got %d buffers want 1", cap(bp.slots))
+	}
+	if bp := newBufferPool(0); bp.slots != nil {
+		t.Error("buffer pool test: zero budget pool is bounded")
+	}
+}
+
+// recordingSink is a body sink keeping the written bytes in memory.
+type recordingSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestHTTPHandlerBodySink(t *testing.T) {
+	bodies := map[string][]byte{
+		"/large": bytes.Repeat([]byte("0123456789"), 3*copyBufferSize/10+7),
+		"/small": []byte("small body"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bodies[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	sinks := make(map[string]*recordingSink)
+	handler := NewHTTPHandler()
+	handler.SetBodySinkFactory(func(url string) io.WriteCloser {
+		mu.Lock()
+		defer mu.Unlock()
+		sinks[url] = &recordingSink{}
+		return sinks[url]
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/large\n"+srv.URL+"/small"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, body := range bodies {
+		url := srv.URL + path
+		sink := sinks[url]
+		if sink == nil {
+			t.Errorf("body sink test: no sink created for %s", url)
+			continue
+		}
+		if size := resps.Map[url].Size; size != int64(len(body)) {
+			t.Errorf("body sink test: %s: got size %d want %d", url, size, len(body))
+		}
+		if !bytes.Equal(sink.Bytes(), body) {
+			t.Errorf("body sink test: %s: got %d bytes in the sink want %d", url, sink.Len(), len(body))
+		}
+		if !sink.closed {
+			t.Errorf("body sink test: %s: sink was not closed", url)
+		}
+	}
+}
+
+func TestHTTPHandlerLargeBodyNotBuffered(t *testing.T) {
+	const chunks, chunkSize = 1024, 32 * 1024
+	chunk := bytes.Repeat([]byte{'x'}, chunkSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+		}
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(10 * time.Second)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if size := resps.Map[srv.URL].Size; size != chunks*chunkSize {
+		t.Errorf("large body test: got size %d want %d", size, chunks*chunkSize)
+	}
+	// The body is counted while it streams, so far less than its size is allocated.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > chunks*chunkSize/4 {
+		t.Errorf("large body test: %d bytes allocated for a %d bytes body", allocated, chunks*chunkSize)
+	}
+}
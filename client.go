@@ -0,0 +1,221 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sensitiveHeaders are redacted from the echoed request headers unless explicitly allowed.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactedValue replaces the values of the redacted headers.
+const redactedValue = "REDACTED"
+
+// transportOf returns the transport used by the client.
+func transportOf(client *http.Client) http.RoundTripper {
+	if client.Transport != nil {
+		return client.Transport
+	}
+	return http.DefaultTransport
+}
+
+// SetClient sets the client the requests are sent with, e.g. to tune its connection pool or to use
+// a custom transport. It defaults to http.DefaultClient, which is also used if the client is nil.
+// The options changing the transport, like SetDNSTimeout or SetPinnedCerts, are applied to a copy of
+// the client whether they are set before or after it. If any of them is set, the client transport
+// must be an *http.Transport, otherwise an error is returned and the client is not changed.
+func (h *HTTPHandler) SetClient(client *http.Client) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return h.applyClient(client)
+}
+
+// SetMaxRedirects sets the maximum number of redirects followed for each URL. When the limit is reached,
+// the last redirect response is recorded as-is, so zero records the 3xx response of the URL itself.
+// A negative number restores the default policy of the client, which is to follow up to 10 redirects.
+func (h *HTTPHandler) SetMaxRedirects(n int) {
+	h.maxRedirects = n
+}
+
+// checkRedirect is the redirect policy of the handler: the host policy and the redirect limit if it is set,
+// otherwise the policy of the client.
+func (h *HTTPHandler) checkRedirect(next *http.Request, via []*http.Request) error {
+	if err := h.checkHost(next.URL.String()); err != nil {
+		return err
+	}
+	if h.maxRedirects >= 0 {
+		if len(via) > h.maxRedirects {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	if h.client.CheckRedirect != nil {
+		return h.client.CheckRedirect(next, via)
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// recordHops returns the redirect policy of the handler, additionally recording every followed redirect to hops.
+func (h *HTTPHandler) recordHops(hops *[]redirectHop, start time.Time) func(*http.Request, []*http.Request) error {
+	return func(next *http.Request, via []*http.Request) error {
+		err := h.checkRedirect(next, via)
+		if err == http.ErrUseLastResponse {
+			// The redirect response is the final one and its body is read as such.
+			return err
+		}
+		prev := next.Response
+		hop := redirectHop{
+			url:      via[len(via)-1].URL.String(),
+			location: next.URL.String(),
+			resp:     Response{Response: prev, StatusCode: prev.StatusCode, Duration: time.Since(start)},
+		}
+		// The client closes the body of the redirect response after this check.
+		hop.resp.Size, hop.resp.Error = io.Copy(io.Discard, prev.Body)
+		*hops = append(*hops, hop)
+		return err
+	}
+}
+
+// headerRecorder is a transport recording the header of the last request it has sent.
+type headerRecorder struct {
+	base   http.RoundTripper
+	header *http.Header
+}
+
+func (hr *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := req.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	*hr.header = header
+	return hr.base.RoundTrip(req)
+}
+
+// SetNoKeepAliveHosts sets the hosts whose connections are not reused. Requests to them are sent
+// with "Connection: close" and their connections are closed after the response is read, while
+// connections to other hosts are kept alive. An entry matches either the host name or host:port.
+func (h *HTTPHandler) SetNoKeepAliveHosts(hosts []string) {
+	h.noKeepAlive = make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		h.noKeepAlive[strings.ToLower(host)] = true
+	}
+}
+
+// SetUserAgent sets the User-Agent header of the requests. When empty, which is the default,
+// the default user agent of the client is sent.
+func (h *HTTPHandler) SetUserAgent(userAgent string) {
+	h.userAgent = userAgent
+}
+
+// SetForwardHeaders sets the headers copied from the incoming batch request to each request it makes,
+// e.g. "Authorization" or "X-Trace-Id". Other headers are never forwarded. The client drops sensitive
+// headers like Authorization when a request is redirected to another domain.
+func (h *HTTPHandler) SetForwardHeaders(names []string) {
+	h.forwardHeaders = make([]string, len(names))
+	for i, name := range names {
+		h.forwardHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+}
+
+// forwardedHeader returns the allowed headers of the batch request, or nil if there are none.
+func (h *HTTPHandler) forwardedHeader(r *http.Request) http.Header {
+	var header http.Header
+	for _, name := range h.forwardHeaders {
+		if values, ok := r.Header[name]; ok {
+			if header == nil {
+				header = make(http.Header)
+			}
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	return header
+}
+
+// SetEchoRequestHeaders sets whether the header of the request sent for each URL is recorded.
+// The values of the Authorization, Proxy-Authorization and Cookie headers are redacted
+// unless allowed with SetEchoUnredactedHeaders.
+func (h *HTTPHandler) SetEchoRequestHeaders(enabled bool) {
+	h.echoHeaders = enabled
+}
+
+// SetEchoUnredactedHeaders sets the sensitive headers that are echoed without redaction.
+func (h *HTTPHandler) SetEchoUnredactedHeaders(names []string) {
+	h.unredacted = make(map[string]bool, len(names))
+	for _, name := range names {
+		h.unredacted[http.CanonicalHeaderKey(name)] = true
+	}
+}
+
+// redactHeaders replaces the values of the sensitive headers that are not explicitly allowed.
+func (h *HTTPHandler) redactHeaders(header http.Header) http.Header {
+	for _, name := range sensitiveHeaders {
+		if _, ok := header[name]; ok && !h.unredacted[name] {
+			header[name] = []string{redactedValue}
+		}
+	}
+	return header
+}
+
+// countingConn is a connection counting the bytes received on it.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// received returns the number of bytes received on the connection so far.
+func (c *countingConn) received() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// countingConnOf returns the counting connection wrapped by conn, or nil if it is not counted.
+func countingConnOf(conn net.Conn) *countingConn {
+	for {
+		switch c := conn.(type) {
+		case *countingConn:
+			return c
+		case interface{ netConn() net.Conn }:
+			conn = c.netConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// SetRecordUndecodableWireSize sets whether the number of bytes received for the responses
+// with an unsupported transfer encoding is recorded as their WireSize, to help diagnosing such servers.
+// It requires the client transport to be an *http.Transport and has no effect on HTTPS connections.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetRecordUndecodableWireSize(enabled bool) {
+	h.countWire = enabled
+	if !enabled {
+		h.setTransportOption(optCountWire, nil)
+		return
+	}
+	// Without an *http.Transport the option is not recorded and the wire size is not known.
+	h.setTransportOption(optCountWire, func(transport *http.Transport, dialer *net.Dialer) {
+		dial := dialOf(transport, dialer)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn}, nil
+		}
+	})
+}
@@ -0,0 +1,475 @@
+package httphandler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerEchoRequestHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	urlString := strings.Replace(srv.URL, "http://", "http://user:secret@", 1)
+
+	handler := NewHTTPHandler()
+	handler.SetEchoRequestHeaders(true)
+	handler.SetCompressionAudit(true)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := resps.Map[urlString].RequestHeader
+	if got := header.Get("Accept-Encoding"); got != "gzip" {
+		t.Errorf("echo headers test: got Accept-Encoding %q want %q", got, "gzip")
+	}
+	if got := header.Get("Authorization"); got != redactedValue {
+		t.Errorf("echo headers test: got Authorization %q want %q", got, redactedValue)
+	}
+
+	handler.SetEchoUnredactedHeaders([]string{"authorization"})
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+	resps, err = handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resps.Map[urlString].RequestHeader.Get("Authorization"); !strings.HasPrefix(got, "Basic ") {
+		t.Errorf("echo headers test: got unredacted Authorization %q", got)
+	}
+}
+
+// connCountingServer is a stub server counting the connections it has accepted.
+type connCountingServer struct {
+	*httptest.Server
+	conns int32
+}
+
+func newConnCountingServer() *connCountingServer {
+	return newConnCountingServerWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+}
+
+func newConnCountingServerWith(handler http.Handler) *connCountingServer {
+	cs := &connCountingServer{}
+	cs.Server = httptest.NewUnstartedServer(handler)
+	cs.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&cs.conns, 1)
+		}
+	}
+	cs.Start()
+	return cs
+}
+
+func (cs *connCountingServer) Conns() int {
+	return int(atomic.LoadInt32(&cs.conns))
+}
+
+func TestHTTPHandlerNoKeepAliveHosts(t *testing.T) {
+	listed := newConnCountingServer()
+	defer listed.Close()
+	pooled := newConnCountingServer()
+	defer pooled.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetNoKeepAliveHosts([]string{strings.TrimPrefix(listed.URL, "http://")})
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(listed.URL+"\n"+pooled.URL+"\n"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("keep-alive test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+	if n := listed.Conns(); n != 3 {
+		t.Errorf("keep-alive test: listed host got %d connections want 3", n)
+	}
+	if n := pooled.Conns(); n != 1 {
+		t.Errorf("keep-alive test: other host got %d connections want 1", n)
+	}
+}
+
+func TestHTTPHandlerUnsupportedTransferEncoding(t *testing.T) {
+	const rawResponse = "HTTP/1.1 200 OK\r\nTransfer-Encoding: x-custom\r\n\r\nhello"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, rawResponse)
+			}()
+		}
+	}()
+	urlString := "http://" + ln.Addr().String()
+
+	for _, record := range []bool{false, true} {
+		handler := NewHTTPHandler()
+		handler.SetRecordUndecodableWireSize(record)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[urlString]
+		if !errors.Is(resp.Error, ErrUnsupportedTransferEncoding) {
+			t.Errorf("transfer encoding test: got error %v want %v", resp.Error, ErrUnsupportedTransferEncoding)
+		}
+		if record && (resp.WireSize <= 0 || resp.WireSize > int64(len(rawResponse))) {
+			t.Errorf("transfer encoding test: got %d received bytes want up to %d", resp.WireSize, len(rawResponse))
+		}
+		if !record && resp.WireSize != 0 {
+			t.Errorf("transfer encoding test: unexpected received bytes %d", resp.WireSize)
+		}
+	}
+}
+
+func TestHTTPHandlerTimeoutDrainGrace(t *testing.T) {
+	for _, tt := range []struct {
+		grace time.Duration
+		conns int
+	}{
+		{grace: 0, conns: 3},
+		{grace: 500 * time.Millisecond, conns: 1},
+	} {
+		// The body finishes arriving shortly after the request timeout.
+		srv := newConnCountingServerWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "8")
+			fmt.Fprint(w, "part")
+			w.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+			fmt.Fprint(w, "rest")
+		}))
+
+		handler := NewHTTPHandler()
+		handler.SetRequestTimeout(100 * time.Millisecond)
+		handler.SetTimeoutDrainGrace(tt.grace)
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+			resps, err := handler.executeAllRequests(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp := resps.Map[srv.URL]; !errors.Is(resp.Error, context.DeadlineExceeded) {
+				t.Errorf("drain test with grace %v: got error %v want %v", tt.grace, resp.Error, context.DeadlineExceeded)
+			}
+		}
+		if n := srv.Conns(); n != tt.conns {
+			t.Errorf("drain test with grace %v: server got %d connections want %d", tt.grace, n, tt.conns)
+		}
+		srv.Close()
+	}
+
+	// The grace period does not extend waiting for the headers.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer srv.Close()
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(100 * time.Millisecond)
+	handler.SetTimeoutDrainGrace(time.Second)
+	start := time.Now()
+	resps, err := handler.Fetch(context.Background(), []string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[srv.URL]; !errors.Is(resp.Error, context.DeadlineExceeded) {
+		t.Errorf("drain test with late headers: got error %v want %v", resp.Error, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("drain test with late headers: got %v want the request timeout", elapsed)
+	}
+}
+
+// closeTracker is a transport counting the response bodies it has returned and the ones closed.
+type closeTracker struct {
+	base           http.RoundTripper
+	opened, closed int32
+}
+
+func (ct *closeTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ct.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&ct.opened, 1)
+	resp.Body = &trackedBody{ReadCloser: resp.Body, closed: &ct.closed}
+	return resp, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	closed *int32
+	once   sync.Once
+}
+
+func (tb *trackedBody) Close() error {
+	tb.once.Do(func() { atomic.AddInt32(tb.closed, 1) })
+	return tb.ReadCloser.Close()
+}
+
+func TestHTTPHandlerClosesBodies(t *testing.T) {
+	srv := newConnCountingServerWith(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 3
+	tracker := &closeTracker{base: transport}
+	handler := NewHTTPHandler()
+	handler.client = &http.Client{Transport: tracker}
+	body := srv.URL + "/a\n" + srv.URL + "/b\n" + srv.URL + "/missing\n"
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("close test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+	opened, closed := atomic.LoadInt32(&tracker.opened), atomic.LoadInt32(&tracker.closed)
+	if opened != 9 || closed != opened {
+		t.Errorf("close test: %d of %d bodies closed, want 9 of 9", closed, opened)
+	}
+	// Closed bodies return their connections to the pool, so they are reused across batches.
+	if n := srv.Conns(); n > 3 {
+		t.Errorf("close test: server got %d connections want at most 3", n)
+	}
+}
+
+// roundTripFunc is a transport answering the requests with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPHandlerSetClient(t *testing.T) {
+	const urlString = "http://stub.invalid/"
+	handler := NewHTTPHandler()
+	handler.SetClient(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("from the stub transport")),
+			Request:    req,
+		}, nil
+	})})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("client test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if body := rr.Body.String(); body != "23\n" {
+		t.Errorf("client test: got sizes %q want %q", body, "23\n")
+	}
+
+	handler.SetClient(nil)
+	if handler.client != http.DefaultClient {
+		t.Error("client test: nil client did not restore the default client")
+	}
+}
+
+func TestHTTPHandlerSetClientAfterTransportOptions(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	if err := handler.SetBlockPrivateAddresses(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SetClient(&http.Client{Transport: &http.Transport{}}); err != nil {
+		t.Fatal(err)
+	}
+	// The stub transport cannot carry the address check, so the client is rejected.
+	stub := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("stub transport used")
+	})}
+	if err := handler.SetClient(stub); err == nil {
+		t.Error("set client test: client without *http.Transport unexpectedly accepted")
+	}
+	resps, err := handler.Fetch(context.Background(), []string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[srv.URL]; !errors.Is(resp.Error, ErrBlockedAddress) {
+		t.Errorf("set client test: got error %v want %v", resp.Error, ErrBlockedAddress)
+	}
+
+	// Once the option is removed, any client is accepted again.
+	if err := handler.SetBlockPrivateAddresses(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SetClient(&http.Client{}); err != nil {
+		t.Fatal(err)
+	}
+	if resps, err = handler.Fetch(context.Background(), []string{srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[srv.URL]; resp.Error != nil || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("set client test: got error %v and %d requests want 1 request", resp.Error, atomic.LoadInt32(&requests))
+	}
+}
+
+func TestHTTPHandlerForwardHeaders(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetForwardHeaders([]string{"authorization", "X-Trace-Id"})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\n"+srv.URL+"/b"))
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Trace-Id", "trace-1")
+	req.Header.Set("X-Other", "secret")
+	if _, err := handler.executeAllRequests(req); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		header := <-headers
+		if got := header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("forward headers test: got Authorization %q want %q", got, "Bearer token")
+		}
+		if got := header.Get("X-Trace-Id"); got != "trace-1" {
+			t.Errorf("forward headers test: got X-Trace-Id %q want %q", got, "trace-1")
+		}
+		if got := header.Get("X-Other"); got != "" {
+			t.Errorf("forward headers test: header not in the allowlist forwarded: %q", got)
+		}
+	}
+}
+
+func TestHTTPHandlerMaxOpenConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	// The second server makes the idle connections to the first one useless for some requests.
+	other := httptest.NewServer(srv.Config.Handler)
+	defer other.Close()
+
+	var open, maxOpen int32
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			n := atomic.AddInt32(&open, 1)
+			for {
+				seen := atomic.LoadInt32(&maxOpen)
+				if n <= seen || atomic.CompareAndSwapInt32(&maxOpen, seen, n) {
+					break
+				}
+			}
+			return &trackedConn{Conn: conn, open: &open}, nil
+		},
+	}
+	handler := NewHTTPHandler()
+	handler.SetClient(&http.Client{Transport: transport})
+	if err := handler.SetMaxOpenConnections(2); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var urls []string
+			for j := 0; j < 4; j++ {
+				urls = append(urls, fmt.Sprintf("%s/%d/%d", srv.URL, i, j), fmt.Sprintf("%s/%d/%d", other.URL, i, j))
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Join(urls, "\n")))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("open connections test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&maxOpen); n > 2 {
+		t.Errorf("open connections test: %d connections were open at the same time, want at most 2", n)
+	}
+
+	if err := handler.SetMaxOpenConnections(-1); err == nil {
+		t.Error("open connections test: negative limit unexpectedly accepted")
+	}
+	if err := handler.SetMaxOpenConnections(0); err != nil {
+		t.Fatal(err)
+	}
+	if handler.transportOpts[optOpenConns] != nil {
+		t.Error("open connections test: zero limit did not disable the limit")
+	}
+}
+
+// trackedConn is a connection decrementing the number of open connections when closed.
+type trackedConn struct {
+	net.Conn
+	open *int32
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(c.open, -1) })
+	return c.Conn.Close()
+}
+
+func TestHTTPHandlerUserAgent(t *testing.T) {
+	userAgents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.UserAgent()
+	}))
+	defer srv.Close()
+
+	for _, userAgent := range []string{"", "linkchecker/1.0 (+https://example.com/bot)"} {
+		handler := NewHTTPHandler()
+		handler.SetUserAgent(userAgent)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		if _, err := handler.executeAllRequests(req); err != nil {
+			t.Fatal(err)
+		}
+		got := <-userAgents
+		if userAgent == "" && !strings.HasPrefix(got, "Go-http-client/") {
+			t.Errorf("user agent test: got default User-Agent %q", got)
+		}
+		if userAgent != "" && got != userAgent {
+			t.Errorf("user agent test: got User-Agent %q want %q", got, userAgent)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// limitedConn is a connection holding a slot of the open connections limit until it is closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// netConn returns the wrapped connection.
+func (c *limitedConn) netConn() net.Conn {
+	return c.Conn
+}
+
+// SetMaxOpenConnections caps the number of connections the handler keeps open at the same time
+// across all the batches, including the idle ones, as a process-wide guard of the file descriptors.
+// It applies in addition to the per-host and per-batch limits. When the limit is reached, the idle
+// connections are closed, and a request needing a new connection waits for one to be closed within its timeout.
+// It requires the client transport to be an *http.Transport and should be called before the handler
+// starts serving requests. Zero disables the limit.
+func (h *HTTPHandler) SetMaxOpenConnections(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid open connections limit %d", n)
+	}
+	if n == 0 {
+		return h.setTransportOption(optOpenConns, nil)
+	}
+	return h.setTransportOption(optOpenConns, func(transport *http.Transport, dialer *net.Dialer) {
+		limitConnections(transport, dialer, n)
+	})
+}
+
+// limitConnections makes the transport keep at most n connections open.
+func limitConnections(transport *http.Transport, dialer *net.Dialer, n int) {
+	dial := dialOf(transport, dialer)
+	slots := make(chan struct{}, n)
+	release := func() { <-slots }
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			// The idle connections hold slots too, so they are closed to make room.
+			transport.CloseIdleConnections()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		return &limitedConn{Conn: conn, release: release}, nil
+	}
+}
@@ -0,0 +1,49 @@
+package httphandler
+
+import "net/http"
+
+// CapturedCookie is a cookie set by the Set-Cookie header of a response.
+type CapturedCookie struct {
+	Name string `json:"name"`
+	// Value is only recorded if the capture of cookie values is enabled.
+	Value string `json:"value,omitempty"`
+	// Stored is set if the cookie was accepted into the cookie jar of the client
+	// rather than merely observed.
+	Stored bool `json:"stored"`
+}
+
+// SetCaptureCookies sets whether the cookies set by each response are recorded.
+// Only the names are recorded unless withValues is set, as the values are often sensitive.
+func (h *HTTPHandler) SetCaptureCookies(enabled, withValues bool) {
+	h.captureCookies = enabled
+	h.cookieValues = withValues
+}
+
+// SetUseCookieJar sets whether the requests of a batch share a cookie jar, so that cookies set
+// by earlier responses are sent with later requests to the same host. Each batch has its own jar.
+// The requests of a batch are performed concurrently and their order is nondeterministic,
+// so the cookie jar is only reliable when combined with SetSequential.
+func (h *HTTPHandler) SetUseCookieJar(enabled bool) {
+	h.useCookieJar = enabled
+}
+
+// recordCookies records the cookies set by the response if the cookie capture is enabled.
+// If the batch has a cookie jar, the cookies accepted by the jar are marked as stored.
+func (h *HTTPHandler) recordCookies(r *Response, jar http.CookieJar) {
+	if !h.captureCookies || r.Response == nil {
+		return
+	}
+	stored := make(map[string]bool)
+	if jar != nil && r.Request != nil {
+		for _, cookie := range jar.Cookies(r.Request.URL) {
+			stored[cookie.Name] = true
+		}
+	}
+	for _, cookie := range r.Cookies() {
+		captured := CapturedCookie{Name: cookie.Name, Stored: stored[cookie.Name]}
+		if h.cookieValues {
+			captured.Value = cookie.Value
+		}
+		r.SetCookies = append(r.SetCookies, captured)
+	}
+}
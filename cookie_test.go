@@ -0,0 +1,69 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerCaptureCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		http.SetCookie(w, &http.Cookie{Name: "tracking", Value: "id42"})
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		withValues bool
+		want       []CapturedCookie
+	}{
+		{false, []CapturedCookie{{Name: "session"}, {Name: "tracking"}}},
+		{true, []CapturedCookie{{Name: "session", Value: "secret"}, {Name: "tracking", Value: "id42"}}},
+	}
+	for i, tt := range tests {
+		handler := NewHTTPHandler()
+		handler.SetCaptureCookies(true, tt.withValues)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatalf("cookie capture test #%d: %v", i, err)
+		}
+		if got := resps.Map[srv.URL].SetCookies; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cookie capture test #%d: got %v want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPHandlerCookieJar(t *testing.T) {
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		case "/profile":
+			if cookie, err := r.Cookie("session"); err == nil {
+				received = cookie.Value
+			}
+		}
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetSequential(true)
+	handler.SetUseCookieJar(true)
+	handler.SetCaptureCookies(true, false)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/login\n"+srv.URL+"/profile"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "abc" {
+		t.Errorf("cookie jar test: session cookie was not sent, got Cookie %q", received)
+	}
+	want := []CapturedCookie{{Name: "session", Stored: true}}
+	if got := resps.Map[srv.URL+"/login"].SetCookies; !reflect.DeepEqual(got, want) {
+		t.Errorf("cookie jar test: got %v want %v", got, want)
+	}
+}
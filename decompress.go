@@ -0,0 +1,104 @@
+package httphandler
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrDecompressionBomb is recorded when a compressed body expands beyond the maximum decompression ratio.
+var ErrDecompressionBomb = errors.New("decompression bomb")
+
+// ErrContentDecoding is recorded when the encoded body cannot be decoded.
+var ErrContentDecoding = errors.New("content decoding failed")
+
+// minBombSize is the decompressed size below which the decompression ratio is not checked,
+// since small bodies can be very compressible without being a threat.
+const minBombSize = 64 << 10
+
+// ratioReader aborts reading the decompressed body once it expands beyond the ratio
+// of the compressed bytes read so far.
+type ratioReader struct {
+	decoded    countingReader
+	compressed *countingReader
+	ratio      float64
+}
+
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.decoded.Read(p)
+	if rr.decoded.n > minBombSize && float64(rr.decoded.n) > rr.ratio*float64(rr.compressed.n) {
+		return n, fmt.Errorf("%w: %d bytes expanded to more than %d", ErrDecompressionBomb, rr.compressed.n, rr.decoded.n)
+	}
+	return n, err
+}
+
+// SetMaxDecompressionRatio sets the ratio of the decompressed to the compressed size of a body
+// decoding is aborted at, recording the URL as failed with ErrDecompressionBomb. While the ratio is set,
+// gzip is requested explicitly and the gzip bodies are decoded by the handler instead of the transport,
+// so that the ratio is checked for them too. The ratio is only checked once the decompressed body
+// exceeds 64 KiB. The decompressed size is also capped by SetMaxBodySize. Zero disables the check.
+func (h *HTTPHandler) SetMaxDecompressionRatio(ratio float64) error {
+	if ratio < 0 {
+		return fmt.Errorf("invalid decompression ratio %v", ratio)
+	}
+	h.maxRatio = ratio
+	return nil
+}
+
+// SetDecompress sets whether the gzip and deflate encoded bodies are decoded, so that their decoded size
+// is recorded instead of the number of bytes received. Both encodings are then requested explicitly.
+// A body that cannot be decoded is recorded as failed, with ErrContentDecoding if its header is invalid.
+// By default the transport of the client decodes gzip bodies it has requested itself, and the size of
+// the other encoded bodies is the number of bytes received.
+func (h *HTTPHandler) SetDecompress(enabled bool) {
+	h.decompress = enabled
+}
+
+// acceptEncoding returns the Accept-Encoding header requested explicitly, or an empty string
+// if it is left to the transport.
+func (h *HTTPHandler) acceptEncoding() string {
+	switch {
+	case h.decompress:
+		return "gzip, deflate"
+	case h.audit || h.maxRatio > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// decodeBody returns the reader decoding the body with its content encoding,
+// or nil if the body is not decoded.
+func (h *HTTPHandler) decodeBody(body io.Reader, encoding string) (io.ReadCloser, error) {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	switch {
+	case (h.audit || h.decompress || h.maxRatio > 0) && (encoding == "gzip" || encoding == "x-gzip"):
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrContentDecoding, encoding, err)
+		}
+		return gz, nil
+	case h.decompress && encoding == "deflate":
+		return newDeflateReader(body)
+	}
+	return nil, nil
+}
+
+// newDeflateReader returns the reader decoding the deflate encoded body. The encoding is meant to be
+// zlib-wrapped, but some servers send raw deflate data, which is decoded too.
+func newDeflateReader(body io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err != nil || header[0]&0x0f != 8 || (uint16(header[0])<<8|uint16(header[1]))%31 != 0 {
+		return flate.NewReader(br), nil
+	}
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: deflate: %v", ErrContentDecoding, err)
+	}
+	return zr, nil
+}
@@ -0,0 +1,144 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrDigestMismatch is recorded when the response body does not match its Content-MD5 or Digest header.
+var ErrDigestMismatch = errors.New("response body digest mismatch")
+
+// digestAlgorithms maps the Digest header algorithms to the hash constructors.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-512": sha512.New,
+	"sha-256": sha256.New,
+	"sha":     sha1.New,
+	"md5":     md5.New,
+}
+
+// bodyDigest is the digest of a response body declared by its headers.
+type bodyDigest struct {
+	hash.Hash
+	expected []byte
+}
+
+// expectedDigest returns the digest declared by the Digest or Content-MD5 response header.
+// The Digest header takes precedence. It returns nil if no supported digest is declared.
+func expectedDigest(header http.Header) *bodyDigest {
+	for _, value := range header.Values("Digest") {
+		for _, entry := range strings.Split(value, ",") {
+			algorithm, encoded, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				continue
+			}
+			newHash, supported := digestAlgorithms[strings.ToLower(algorithm)]
+			if !supported {
+				continue
+			}
+			expected, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				continue
+			}
+			return &bodyDigest{Hash: newHash(), expected: expected}
+		}
+	}
+	if encoded := header.Get("Content-MD5"); encoded != "" {
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			return &bodyDigest{Hash: md5.New(), expected: expected}
+		}
+	}
+	return nil
+}
+
+// verify compares the digest of the data written to the expected one.
+func (d *bodyDigest) verify() error {
+	if !bytes.Equal(d.Sum(nil), d.expected) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+// SetVerifyDigest enables verification of the response bodies against their Digest or Content-MD5 headers.
+// The digest is computed over the body as received. A mismatch is recorded as ErrDigestMismatch.
+// The bodies decoded transparently by the transport are not verified, since their encoded bytes are not available.
+func (h *HTTPHandler) SetVerifyDigest(enabled bool) {
+	h.verifyDigest = enabled
+}
+
+// writeBodyHashGroups writes a section listing the URLs whose responses have byte-identical bodies.
+// Each line contains the hash of the body followed by the URLs, separated by tabs.
+// Groups are written in the order of their first URL in keys; failed responses are not grouped.
+func writeBodyHashGroups(w io.Writer, resps *ResponseMap, keys []string) {
+	groups := make(map[string][]string)
+	var hashes []string
+	for _, key := range keys {
+		resp := resps.Map[key]
+		if resp.Error != nil || resp.BodyHash == "" {
+			continue
+		}
+		if _, ok := groups[resp.BodyHash]; !ok {
+			hashes = append(hashes, resp.BodyHash)
+		}
+		groups[resp.BodyHash] = append(groups[resp.BodyHash], key)
+	}
+	mustWrite(w, "# identical bodies\n")
+	for _, bodyHash := range hashes {
+		if urls := groups[bodyHash]; len(urls) > 1 {
+			mustWrite(w, bodyHash+"\t"+strings.Join(urls, "\t")+"\n")
+		}
+	}
+}
+
+// SetGroupByBodyHash sets whether the hash of each response body is recorded and the text output
+// is followed by a section grouping the URLs that serve byte-identical content.
+// The hash is SHA-256 unless another algorithm is set with SetHash.
+func (h *HTTPHandler) SetGroupByBodyHash(enabled bool) {
+	h.groupByHash = enabled
+}
+
+// bodyHashAlgorithms maps the algorithms accepted by SetHash to the hash constructors.
+var bodyHashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// SetHash sets the algorithm of the hash computed over each response body, "sha256" or "md5",
+// e.g. to detect changed content across runs without storing the bodies. The hex-encoded hash is
+// recorded as BodyHash and written after the size in the text and tab-separated outputs, following
+// the status and duration columns if they are enabled, and as hash in the JSON output.
+// If the body exceeds the maximum body size, only the part that was read is hashed.
+// An empty algorithm disables the hash.
+func (h *HTTPHandler) SetHash(algorithm string) error {
+	if algorithm == "" {
+		h.hashAlgo = nil
+		return nil
+	}
+	newHash, ok := bodyHashAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		return fmt.Errorf("unsupported hash algorithm %s", algorithm)
+	}
+	h.hashAlgo = newHash
+	return nil
+}
+
+// newBodyHash returns the hash of the response body, or nil if it is not computed.
+func (h *HTTPHandler) newBodyHash() hash.Hash {
+	switch {
+	case h.hashAlgo != nil:
+		return h.hashAlgo()
+	case h.groupByHash:
+		return sha256.New()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package httphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerVerifyDigest(t *testing.T) {
+	content := []byte("digest verification")
+	sha := sha256.Sum256(content)
+	sum := md5.Sum(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/digest":
+			w.Header().Set("Digest", "unknown=abc, SHA-256="+base64.StdEncoding.EncodeToString(sha[:]))
+		case "/md5":
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		case "/wrong":
+			w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetVerifyDigest(true)
+	urls := []string{srv.URL + "/digest", srv.URL + "/md5", srv.URL + "/wrong", srv.URL + "/none"}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Join(urls, "\n")))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		verified bool
+		err      error
+	}{
+		{url: urls[0], verified: true},
+		{url: urls[1], verified: true},
+		{url: urls[2], err: ErrDigestMismatch},
+		{url: urls[3]},
+	}
+	for _, tt := range tests {
+		resp := resps.Map[tt.url]
+		if resp.DigestVerified != tt.verified || !errors.Is(resp.Error, tt.err) {
+			t.Errorf("digest test: %s: got verified %v, error %v want verified %v, error %v",
+				tt.url, resp.DigestVerified, resp.Error, tt.verified, tt.err)
+		}
+	}
+}
+
+func TestHTTPHandlerVerifyDigestGzip(t *testing.T) {
+	var encoded bytes.Buffer
+	gz := gzip.NewWriter(&encoded)
+	gz.Write([]byte("digest of the encoded body"))
+	gz.Close()
+	sha := sha256.Sum256(encoded.Bytes())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sha[:]))
+		w.Write(encoded.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name     string
+		audit    bool
+		verified bool
+	}{
+		// The transport decodes the body it requested gzipped itself, so the digest cannot be verified.
+		{name: "transparent", audit: false, verified: false},
+		// The compression audit decodes the body after the digest has been computed over it.
+		{name: "audit", audit: true, verified: true},
+	} {
+		handler := NewHTTPHandler()
+		handler.SetVerifyDigest(true)
+		handler.SetCompressionAudit(tt.audit)
+		resps, err := handler.Fetch(context.Background(), []string{srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL]
+		if resp.Error != nil || resp.DigestVerified != tt.verified {
+			t.Errorf("gzip digest test %s: got verified %v, error %v want verified %v",
+				tt.name, resp.DigestVerified, resp.Error, tt.verified)
+		}
+	}
+}
+
+func TestHTTPHandlerGroupByBodyHash(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/other" {
+			fmt.Fprint(w, "other")
+			return
+		}
+		fmt.Fprint(w, "same")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetGroupByBodyHash(true)
+	if err := handler.SetOutputOrder(OrderInput); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\n"+srv.URL+"/other\n"+srv.URL+"/b"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	sum := sha256.Sum256([]byte("same"))
+	want := fmt.Sprintf("4\n5\n4\n# identical bodies\n%s\t%s/a\t%s/b\n", hex.EncodeToString(sum[:]), srv.URL, srv.URL)
+	if got := rr.Body.String(); got != want {
+		t.Errorf("body hash test: got body %q want %q", got, want)
+	}
+}
+
+func TestHTTPHandlerHash(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+	sha := sha256.Sum256([]byte("content"))
+	md := md5.Sum([]byte("content"))
+	prefix := md5.Sum([]byte("cont"))
+
+	for _, tt := range []struct {
+		algorithm string
+		maxSize   int64
+		hash      string
+	}{
+		{algorithm: "sha256", hash: hex.EncodeToString(sha[:])},
+		{algorithm: "MD5", hash: hex.EncodeToString(md[:])},
+		{algorithm: "md5", maxSize: 4, hash: hex.EncodeToString(prefix[:])},
+	} {
+		handler := NewHTTPHandler()
+		if err := handler.SetHash(tt.algorithm); err != nil {
+			t.Fatal(err)
+		}
+		handler.SetMaxBodySize(tt.maxSize)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"\nhttp://127.0.0.1:1"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		size := int64(len("content"))
+		if tt.maxSize > 0 {
+			size = tt.maxSize
+		}
+		if want := fmt.Sprintf("%d\t%s\n-1\t-\n", size, tt.hash); rr.Body.String() != want {
+			t.Errorf("hash test with %s: got body %q want %q", tt.algorithm, rr.Body.String(), want)
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		req.Header.Set("Accept", "application/json")
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if !strings.Contains(rr.Body.String(), `"hash":"`+tt.hash+`"`) {
+			t.Errorf("hash test with %s: hash missing from JSON %s", tt.algorithm, rr.Body.String())
+		}
+	}
+
+	if err := NewHTTPHandler().SetHash("crc32"); err == nil {
+		t.Error("hash test: unsupported algorithm accepted")
+	}
+}
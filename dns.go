@@ -0,0 +1,89 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrDNSTimeout is recorded when the host name of a URL could not be resolved within the DNS timeout.
+var ErrDNSTimeout = errors.New("DNS resolution timed out")
+
+// SetDNSTimeout bounds the time spent resolving the host name of each connection, so that batches
+// with many dead host names fail fast instead of waiting for the resolver. The lookups exceeding
+// the timeout fail with ErrDNSTimeout. The timeout only covers the resolution and complements the request timeout.
+// It requires the client transport to be an *http.Transport and should be called before the handler
+// starts serving requests. Zero disables the timeout.
+func (h *HTTPHandler) SetDNSTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("invalid DNS timeout %v", timeout)
+	}
+	if timeout == 0 {
+		return h.setTransportOption(optDNSTimeout, nil)
+	}
+	return h.setTransportOption(optDNSTimeout, func(transport *http.Transport, dialer *net.Dialer) {
+		h.resolveWithTimeout(transport, dialer, timeout)
+	})
+}
+
+// resolveWithTimeout makes the transport resolve the host names within the timeout and dial the resolved addresses.
+func (h *HTTPHandler) resolveWithTimeout(transport *http.Transport, dialer *net.Dialer, timeout time.Duration) {
+	resolver := h.lookupResolver()
+	dial := dialOf(transport, dialer)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		ips, err := resolver.LookupIPAddr(lookupCtx, host)
+		timedOut := lookupCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		var dnsErr *net.DNSError
+		if timedOut || (errors.As(err, &dnsErr) && dnsErr.IsTimeout) {
+			return nil, fmt.Errorf("%w: %s", ErrDNSTimeout, host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dialAddresses(ctx, dial, network, host, port, ips)
+	}
+}
+
+// SetResolver sets the resolver the host names are resolved with by SetDNSTimeout and SetBlockPrivateAddresses,
+// e.g. to query a particular DNS server. nil, which is the default, uses net.DefaultResolver.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetResolver(resolver *net.Resolver) {
+	h.resolver = resolver
+	// The recorded options already apply to the client, so applying them again cannot fail.
+	h.applyClient(h.baseClient)
+}
+
+// lookupResolver returns the resolver the host names are resolved with by the transport options.
+func (h *HTTPHandler) lookupResolver() *net.Resolver {
+	if h.resolver == nil {
+		return net.DefaultResolver
+	}
+	return h.resolver
+}
+
+// dialAddresses dials the resolved addresses of the host in order, like the default dialer does.
+func dialAddresses(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network, host, port string, ips []net.IPAddr) (net.Conn, error) {
+	var err error = &net.DNSError{Err: "no suitable address found", Name: host}
+	for _, ip := range ips {
+		if (strings.HasSuffix(network, "4") && ip.IP.To4() == nil) || (strings.HasSuffix(network, "6") && ip.IP.To4() != nil) {
+			continue
+		}
+		conn, dialErr := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
+}
@@ -0,0 +1,57 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerDNSTimeout(t *testing.T) {
+	// The DNS server never answers, so the lookups only end with the DNS timeout.
+	blackhole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	if err := handler.SetDNSTimeout(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// The resolver applies to the option set before it.
+	handler.SetResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", blackhole.LocalAddr().String())
+		},
+	})
+	const urlString = "http://dead-host.example/"
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DNS timeout test: failure took %v", elapsed)
+	}
+	if resp := resps.Map[urlString]; !errors.Is(resp.Error, ErrDNSTimeout) {
+		t.Errorf("DNS timeout test: got error %v want %v", resp.Error, ErrDNSTimeout)
+	}
+
+	if err := handler.SetDNSTimeout(-time.Second); err == nil {
+		t.Error("DNS timeout test: negative timeout unexpectedly accepted")
+	}
+	if err := handler.SetDNSTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+	if handler.transportOpts[optDNSTimeout] != nil {
+		t.Error("DNS timeout test: zero timeout did not disable the timeout")
+	}
+}
@@ -0,0 +1,36 @@
+package httphandler
+
+import "math"
+
+// entropyWriter counts the frequency of each byte value written to it.
+type entropyWriter struct {
+	counts [256]int64
+	total  int64
+}
+
+func (ew *entropyWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		ew.counts[b]++
+	}
+	ew.total += int64(len(p))
+	return len(p), nil
+}
+
+// entropy returns the Shannon entropy of the written bytes in bits per byte, from 0 to 8.
+func (ew *entropyWriter) entropy() float64 {
+	var entropy float64
+	for _, count := range ew.counts {
+		if count > 0 {
+			p := float64(count) / float64(ew.total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// SetComputeEntropy sets whether the Shannon entropy of each response body is recorded as its Entropy,
+// in bits per byte. Values close to 8 hint at encrypted or compressed content. The entropy is computed
+// from a histogram of the byte values while the body is streamed.
+func (h *HTTPHandler) SetComputeEntropy(enabled bool) {
+	h.computeEntropy = enabled
+}
@@ -0,0 +1,51 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerComputeEntropy(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/random":
+			w.Write(random)
+		case "/repetitive":
+			w.Write(bytes.Repeat([]byte("ab"), 32*1024))
+		}
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetComputeEntropy(true)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/random\n"+srv.URL+"/repetitive\n"+srv.URL+"/empty"))
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var results map[string]struct {
+		Entropy *float64 `json:"entropy"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path     string
+		min, max float64
+	}{
+		{path: "/random", min: 7.9, max: 8},
+		{path: "/repetitive", min: 1, max: 1},
+		{path: "/empty", min: 0, max: 0},
+	} {
+		entropy := results[srv.URL+tt.path].Entropy
+		if entropy == nil || *entropy < tt.min || *entropy > tt.max {
+			t.Errorf("entropy test: %s: got entropy %v want between %v and %v", tt.path, entropy, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package httphandler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// batchETag returns a weak entity tag of the batch result in the output mode. It only depends on the URLs,
+// their sizes, status codes and whether they have failed, so that it stays the same for an unchanged result.
+func batchETag(resps *ResponseMap, mode OutputMode) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\n", mode)
+	for _, key := range resps.Keys(OrderURL) {
+		resp := resps.Map[key]
+		fmt.Fprintf(hash, "%q %d %d %t\n", key, resp.Size, resp.StatusCode, resp.Error != nil)
+	}
+	return `W/"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header value matches the entity tag
+// using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified sets the ETag header of the batch result and responds with 304 Not Modified
+// if the request has a matching If-None-Match header. It reports whether the response was written.
+func (h *HTTPHandler) writeNotModified(w http.ResponseWriter, r *http.Request, resps *ResponseMap, mode OutputMode) bool {
+	if !h.batchETags {
+		return false
+	}
+	etag := batchETag(resps, mode)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// SetBatchETags sets whether the batch results are sent with a weak ETag computed from the URLs,
+// their sizes and status codes. A client resubmitting the batch with the tag in the If-None-Match header
+// receives 304 Not Modified without a body if the result has not changed. The URLs are still fetched
+// to compute the result.
+func (h *HTTPHandler) SetBatchETags(enabled bool) {
+	h.batchETags = enabled
+}
@@ -0,0 +1,45 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerBatchETags(t *testing.T) {
+	body := "first"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetBatchETags(true)
+	serve := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\n"+srv.URL+"/b"))
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag test: unexpected first response %v with ETag %q", rr.Code, etag)
+	}
+	rr = serve(etag)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("ETag test: unchanged result: got %v with %d bytes want %v", rr.Code, rr.Body.Len(), http.StatusNotModified)
+	}
+
+	body = "changed"
+	rr = serve(etag)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("ETag test: changed result: got %v with ETag %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,45 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// SetHTTPSFallback sets whether an https URL that fails with a TLS or connection error is requested
+// again over plain http, for lenient link checking. The responses of the URLs requested again are marked
+// with HTTPSFallback, and if they are received, their FinalURL has the http scheme. The http URL must
+// still start with the required URL prefix, and certificate pin mismatches are never retried.
+// This is insecure: an attacker able to break the TLS connections can serve the responses in plain text.
+func (h *HTTPHandler) SetHTTPSFallback(enabled bool) {
+	h.httpsFallback = enabled
+}
+
+// fetchWithFallback performs request on a single URL, falling back from https to http if enabled.
+func (h *HTTPHandler) fetchWithFallback(ctx context.Context, url string, cfg batchConfig, deadline time.Time) (r Response, hops []redirectHop) {
+	r, hops = h.fetchFiltered(ctx, url, cfg, deadline)
+	if !h.httpsFallback || r.Error == nil || ctx.Err() != nil || !fallbackError(r.Error) {
+		return r, hops
+	}
+	if !strings.HasPrefix(strings.ToLower(url), "https://") {
+		return r, hops
+	}
+	fallback := "http://" + url[len("https://"):]
+	if h.validateURL(fallback) != nil {
+		return r, hops
+	}
+	r, hops = h.fetchFiltered(ctx, fallback, cfg, deadline)
+	r.HTTPSFallback = true
+	return r, hops
+}
+
+// fallbackError reports whether the request has failed before an https response could be received.
+func fallbackError(err error) bool {
+	if errors.Is(err, ErrCertificatePinMismatch) || errors.Is(err, ErrBlockedAddress) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.Is(err, ErrTLSFailure) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
@@ -0,0 +1,51 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerHTTPSFallback(t *testing.T) {
+	// The server only speaks plain http, so the TLS handshake fails.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain")
+	}))
+	defer srv.Close()
+	httpsURL := strings.Replace(srv.URL, "http://", "https://", 1)
+
+	for _, tt := range []struct {
+		fallback bool
+		prefix   string
+		ok       bool
+	}{
+		{fallback: false},
+		{fallback: true, ok: true},
+		// The http URL does not match the required prefix.
+		{fallback: true, prefix: "https://"},
+	} {
+		handler := NewHTTPHandler()
+		handler.SetHTTPSFallback(tt.fallback)
+		handler.SetRequiredURLPrefix(tt.prefix)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(httpsURL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[httpsURL]
+		if (resp.Error == nil) != tt.ok || resp.HTTPSFallback != tt.ok {
+			t.Errorf("fallback test %+v: got fallback %v error %v", tt, resp.HTTPSFallback, resp.Error)
+		}
+		if !tt.ok {
+			continue
+		}
+		if resp.FinalURL != srv.URL || resp.Size != int64(len("plain")) {
+			t.Errorf("fallback test %+v: got final URL %q size %d", tt, resp.FinalURL, resp.Size)
+		}
+		if result := newJSONResult(httpsURL, resp); result.Scheme != "http" {
+			t.Errorf("fallback test %+v: got reported scheme %q want %q", tt, result.Scheme, "http")
+		}
+	}
+}
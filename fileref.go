@@ -0,0 +1,106 @@
+package httphandler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrFileRefOutsideDir is returned when a file reference points outside of the allowed directory.
+var ErrFileRefOutsideDir = errors.New("file reference outside of the allowed directory")
+
+// fileRefPrefix starts the request body referencing a file with the URL list.
+const fileRefPrefix = '@'
+
+// gzipMagic starts gzipped files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// SetAllowFileRefs sets whether the request body can reference a local file with the URL list,
+// e.g. "@lists/urls.txt". The file may be gzipped. References are resolved relative to the directory
+// set with SetAllowedDir and must not point outside of it. When disabled, which is the default,
+// the reference is treated as a URL and fails validation.
+func (h *HTTPHandler) SetAllowFileRefs(allow bool) {
+	h.allowFileRefs = allow
+}
+
+// SetAllowedDir sets the directory the file references are confined to.
+func (h *HTTPHandler) SetAllowedDir(dir string) {
+	h.allowedDir = dir
+}
+
+// optionsPrefix starts the options line of the request body.
+const optionsPrefix = '{'
+
+// bodySource returns the source of URLs listed in the request body, or in the file it references.
+// If the body starts with an options line, the options are applied to cfg. The list is parsed
+// as a sitemap if the body has an XML content type or the list starts with '<'.
+// The returned closer releases the referenced file.
+func (h *HTTPHandler) bodySource(body io.Reader, contentType string, cfg *batchConfig) (urls urlSource, closer io.Closer, err error) {
+	reader := bufio.NewReader(body)
+	if first, err := reader.Peek(1); err == nil && first[0] == optionsPrefix {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if err = parseBodyOptions(line, cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !h.allowFileRefs {
+		return newURLSource(contentType, reader), io.NopCloser(reader), nil
+	}
+	if first, err := reader.Peek(1); err != nil || first[0] != fileRefPrefix {
+		return newURLSource(contentType, reader), io.NopCloser(reader), nil
+	}
+	ref, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	file, err := h.openFileRef(strings.TrimSpace(ref[1:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	fileReader := bufio.NewReader(file)
+	if magic, _ := fileReader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(fileReader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return newURLSource("", bufio.NewReader(gz)), file, nil
+	}
+	return newURLSource("", fileReader), file, nil
+}
+
+// openFileRef opens the referenced file after making sure it is inside of the allowed directory.
+func (h *HTTPHandler) openFileRef(ref string) (*os.File, error) {
+	if h.allowedDir == "" {
+		return nil, errors.New("allowed directory for file references is not set")
+	}
+	dir, err := filepath.EvalSymlinks(h.allowedDir)
+	if err != nil {
+		return nil, err
+	}
+	path := ref
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path, err = filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return nil, err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%w: %s", ErrFileRefOutsideDir, ref)
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,71 @@
+package httphandler
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerFileRefs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "lists")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(dir, "urls.txt.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(file)
+	fmt.Fprintf(gz, "%s/a\n%s/b\n", srv.URL, srv.URL)
+	gz.Close()
+	file.Close()
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte(srv.URL), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewHTTPHandler()
+	handler.SetAllowFileRefs(true)
+	handler.SetAllowedDir(dir)
+
+	tests := []struct {
+		name     string
+		handler  *HTTPHandler
+		body     string
+		respCode int
+		err      error
+	}{
+		{name: "relative", handler: handler, body: "@urls.txt.gz", respCode: http.StatusOK},
+		{name: "absolute", handler: handler, body: "@" + filepath.Join(dir, "urls.txt.gz") + "\n", respCode: http.StatusOK},
+		{name: "traversal", handler: handler, body: "@../secret.txt", respCode: http.StatusBadRequest, err: ErrFileRefOutsideDir},
+		{name: "disabled", handler: NewHTTPHandler(), body: "@urls.txt.gz", respCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("file refs test %s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.respCode)
+		}
+		if tt.respCode == http.StatusOK && rr.Body.String() != "2\n2\n" {
+			t.Errorf("file refs test %s: handler returned unexpected body: %q", tt.name, rr.Body.String())
+		}
+		if tt.err != nil {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if _, err := tt.handler.executeAllRequests(req); !errors.Is(err, tt.err) {
+				t.Errorf("file refs test %s: got error %v want %v", tt.name, err, tt.err)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package httphandler
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// framesMediaType selects the binary frames output.
+const framesMediaType = "application/vnd.httphandler.frames"
+
+// frameHeaderSize is the size of the URL length prefix of a frame.
+const frameHeaderSize = 4
+
+// writeFrames writes each response as a length-prefixed binary frame: the 4-byte big-endian length
+// of the URL, the URL, the 8-byte big-endian size (-1 for failed requests) and the status byte,
+// which is the class of the status code (e.g. 2 for 2xx) or 0 if no response was received.
+func (h *HTTPHandler) writeFrames(w io.Writer, resps *ResponseMap) {
+	for _, key := range resps.Keys(h.outputOrder) {
+		frame := appendFrame(nil, key, resps.Map[key])
+		for n := h.occurrences(resps, key); n > 0; n-- {
+			if _, err := w.Write(frame); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+// appendFrame appends the binary frame of the response to b.
+func appendFrame(b []byte, url string, resp Response) []byte {
+	size := resp.Size
+	if resp.Error != nil {
+		size = -1
+	}
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(url)))
+	b = append(b, header[:]...)
+	b = append(b, url...)
+	var sizeBytes [8]byte
+	binary.BigEndian.PutUint64(sizeBytes[:], uint64(size))
+	b = append(b, sizeBytes[:]...)
+	return append(b, byte(resp.StatusCode/100))
+}
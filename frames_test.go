@@ -0,0 +1,77 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// frame is a decoded binary frame of the output.
+type frame struct {
+	url    string
+	size   int64
+	status byte
+}
+
+// readFrames decodes the binary frames output.
+func readFrames(r io.Reader) ([]frame, error) {
+	var frames []frame
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return nil, err
+		}
+		url := make([]byte, length)
+		if _, err := io.ReadFull(r, url); err != nil {
+			return nil, err
+		}
+		f := frame{url: string(url)}
+		if err := binary.Read(r, binary.BigEndian, &f.size); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &f.status); err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+func TestHTTPHandlerFramesOutput(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprint(w, "body")
+	}))
+	defer srv.Close()
+	const failedURL = "http://127.0.0.1:1"
+
+	handler := NewHTTPHandler()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/ok\n"+failedURL+"\n"+srv.URL+"/missing"))
+	req.Header.Set("Accept", framesMediaType)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if ct := rr.Header().Get("Content-Type"); ct != framesMediaType {
+		t.Errorf("frames output test: unexpected content type %q", ct)
+	}
+	frames, err := readFrames(bytes.NewReader(rr.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []frame{
+		{url: srv.URL + "/ok", size: 4, status: 2},
+		{url: failedURL, size: -1, status: 0},
+		{url: srv.URL + "/missing", size: 4, status: 4},
+	}
+	if !reflect.DeepEqual(frames, want) {
+		t.Errorf("frames output test: got %+v want %+v", frames, want)
+	}
+}
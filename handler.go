@@ -1,42 +1,202 @@
 package httphandler
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrTooManyServerErrors is returned when the batch is aborted because of too many 5xx responses.
+var ErrTooManyServerErrors = errors.New("too many server errors")
+
+// ErrURLPrefixMismatch is returned when a URL does not start with the required prefix.
+var ErrURLPrefixMismatch = errors.New("URL does not match the required prefix")
+
+// ErrSchemeNotAllowed is returned when the scheme of a URL is not one of the allowed schemes.
+var ErrSchemeNotAllowed = errors.New("URL scheme is not allowed")
+
+// ErrURLRejected is recorded when the URL rewriter rejects a URL.
+var ErrURLRejected = errors.New("URL rejected by the rewriter")
+
+// ErrEmptyResponse is recorded when the server closes the connection without sending a response.
+var ErrEmptyResponse = errors.New("empty response from server")
+
+// ErrUnsupportedTransferEncoding is recorded when the response uses a transfer encoding the client cannot decode.
+var ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+
+// ErrSizeOutOfRange is recorded when the size of a successful response is outside of the acceptable range.
+var ErrSizeOutOfRange = errors.New("size out of range")
+
+// ErrMissingContentType is recorded when a 2xx response has no Content-Type header and it is required.
+var ErrMissingContentType = errors.New("missing Content-Type header")
+
+// ErrRequestPanic is recorded when performing the request, including the hooks called for it, has panicked.
+var ErrRequestPanic = errors.New("panic while performing the request")
+
+// ErrDuplicateURL is returned by ResponseMap.Create for a URL that has already been added.
+var ErrDuplicateURL = errors.New("duplicate URL")
+
 type Response struct {
 	*http.Response
 	Error error
+	// StatusCode is the status code of the response, or zero if no response was received.
+	// It shadows the field of the embedded response and is filled from it by SetResponse if left zero.
+	StatusCode int
+	// Size is the size of the response body. If the compression audit is enabled,
+	// it is the size of the decompressed body.
+	Size int64
+	// WireSize is the size of the response body as it was received.
+	// It is only recorded if the compression audit is enabled. If the transfer encoding of the response
+	// is not supported, it is the number of bytes received for the response, including the headers,
+	// if recorded with SetRecordUndecodableWireSize.
+	WireSize int64
+	// Duration is the time until the response headers were received or the request has failed.
+	Duration time.Duration
+	// SLAViolated is set if the response was received after the SLA threshold.
+	SLAViolated bool
+	// RemoteIP is the address of the server the response was received from.
+	// It is only recorded if trace collection is enabled.
+	RemoteIP string
+	// DigestVerified is set if the body matches its Digest or Content-MD5 header.
+	DigestVerified bool
+	// HeadersTruncated is set if some of the response headers were dropped
+	// because of the captured headers limit.
+	HeadersTruncated bool
+	// RequestHeader is the header of the last request sent for the URL, with the sensitive values redacted.
+	// It is only recorded if echoing of the request headers is enabled.
+	RequestHeader http.Header
+	// BodySkipped is set if only the headers were requested because the content type
+	// did not match the download filter. Size is then taken from the Content-Length header.
+	BodySkipped bool
+	// SetCookies are the cookies set by the response.
+	// They are only recorded if the cookie capture is enabled.
+	SetCookies []CapturedCookie
+	// BodyHash is the hex-encoded hash of the response body, SHA-256 unless set with SetHash.
+	// It is only recorded if the hash is set or grouping by body hash is enabled.
+	BodyHash string
+	// Preview is the beginning of the response body.
+	// It is only recorded if body previews are enabled.
+	Preview string
+	// FinalURL is the URL the response was received from, which differs from the requested URL
+	// if the request was redirected.
+	FinalURL string
+	// HTTPSFallback is set if the https URL has failed and was requested over http instead.
+	HTTPSFallback bool
+	// Entropy is the Shannon entropy of the response body in bits per byte.
+	// It is only recorded if entropy computation is enabled.
+	Entropy float64
+	// Attachment is set if the response has the "Content-Disposition: attachment" header,
+	// and AttachmentFilename is the file name it suggests. They are only recorded if attachment detection is enabled.
+	Attachment         bool
+	AttachmentFilename string
+	// BodyTruncated is set if reading the body was stopped at the maximum body size.
+	// Size is then the maximum body size.
+	BodyTruncated bool
 }
 
+// Summary contains the aggregate counters of a batch.
+type Summary struct {
+	Total         int
+	Failed        int
+	SLAViolations int
+	// ServerErrors is the number of responses with 5xx status codes.
+	// They are not counted as failed.
+	ServerErrors int
+	// Lines is the number of URLs listed in the request, including the skipped ones.
+	Lines int
+	// Fetched is the number of listed URLs that were requested.
+	Fetched int
+	// SkippedInvalid, SkippedDuplicate and Denied are the numbers of listed URLs that were not requested
+	// because they were invalid, repeated an earlier URL or were rejected by the policy: the required prefix,
+	// the host lists or the address blocking. Together with Fetched they add up to Lines.
+	// The URLs rejected by the host lists or the address blocking are still reported with their errors.
+	SkippedInvalid   int
+	SkippedDuplicate int
+	Denied           int
+	// Filtered is the number of fetched URLs whose body was not downloaded because of the content type filter.
+	Filtered int
+	// Attachments is the number of responses with the attachment disposition, if their detection is enabled.
+	Attachments int
+	// QueueWait is the time the batch has waited for a request slot when it was served,
+	// and the total of the batches in a session summary.
+	QueueWait time.Duration
+}
+
+// inputOutcome is what happened to a URL listed in the request.
+type inputOutcome int
+
+const (
+	inputFetched inputOutcome = iota
+	inputInvalid
+	inputDuplicate
+	inputDenied
+	inputOutcomes
+)
+
 type ResponseMap struct {
 	sync.Mutex
-	Map    map[string]Response
-	failed int
+	Map           map[string]Response
+	failed        int
+	slaViolations int
+	serverErrors  int
+	filtered      int
+	attachments   int
+	inputs        [inputOutcomes]int
+	// duplicates is the number of times each URL was listed again after the first time.
+	duplicates map[string]int
+	// assigned holds the URLs whose response has been set.
+	assigned map[string]bool
+	// created and completed are the URLs in the order they were added and responded.
+	created   []string
+	completed []string
+	// queueWait is the time the batch has waited for a request slot.
+	queueWait time.Duration
 }
 
 func NewResponseMap() *ResponseMap {
 	return &ResponseMap{
-		Map: make(map[string]Response),
+		Map:      make(map[string]Response),
+		assigned: make(map[string]bool),
 	}
 }
 
 // Create is used to add an URL to the set.
-// This method should be used before any requests are actually made.
-// It should not be called concurrently.
+// This method should be used before the request to the URL is actually made.
+// Each URL is only added once: adding it again returns ErrDuplicateURL and keeps the existing entry,
+// so that exactly one request is made for every URL in the set.
 func (rs *ResponseMap) Create(urlString string) error {
 	_, err := url.Parse(urlString)
 	if err != nil {
 		return err
 	}
+	rs.Lock()
+	defer rs.Unlock()
+	if _, ok := rs.Map[urlString]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicateURL, urlString)
+	}
+	rs.created = append(rs.created, urlString)
 	rs.Map[urlString] = Response{}
 	return nil
 }
@@ -45,16 +205,73 @@ func (rs *ResponseMap) Create(urlString string) error {
 func (rs *ResponseMap) SetResponse(url string, r Response) error {
 	rs.Lock()
 	defer rs.Unlock()
-	if v, ok := rs.Map[url]; ok && (v != Response{}) {
+	if rs.assigned[url] {
 		return fmt.Errorf("response from %s already exists", url)
 	}
+	if rs.assigned == nil {
+		rs.assigned = make(map[string]bool)
+	}
+	rs.assigned[url] = true
+	if r.StatusCode == 0 && r.Response != nil {
+		r.StatusCode = r.Response.StatusCode
+	}
+	if _, ok := rs.Map[url]; !ok {
+		rs.created = append(rs.created, url)
+	}
+	rs.completed = append(rs.completed, url)
 	rs.Map[url] = r
 	if r.Error != nil {
 		rs.failed++
 	}
+	if r.SLAViolated {
+		rs.slaViolations++
+	}
+	if r.StatusCode >= 500 {
+		rs.serverErrors++
+	}
+	if r.BodySkipped {
+		rs.filtered++
+	}
+	if r.Attachment {
+		rs.attachments++
+	}
 	return nil
 }
 
+// countInput counts the outcome of a URL listed in the request.
+func (rs *ResponseMap) countInput(outcome inputOutcome) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.inputs[outcome]++
+}
+
+// countDenied recounts a fetched URL as denied once its request is rejected by the host lists
+// or the address blocking.
+func (rs *ResponseMap) countDenied() {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.inputs[inputFetched]--
+	rs.inputs[inputDenied]++
+}
+
+// countDuplicate counts a URL listed in the request more than once.
+func (rs *ResponseMap) countDuplicate(url string) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.inputs[inputDuplicate]++
+	if rs.duplicates == nil {
+		rs.duplicates = make(map[string]int)
+	}
+	rs.duplicates[url]++
+}
+
+// serverErrorCount returns the number of responses with 5xx status codes.
+func (rs *ResponseMap) serverErrorCount() int {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.serverErrors
+}
+
 // AllFailed returns true if all the requests have failed.
 // It should not be called concurrently.
 func (rs *ResponseMap) AllFailed() bool {
@@ -67,6 +284,51 @@ func (rs *ResponseMap) AllSuccessful() bool {
 	return rs.failed == 0
 }
 
+// Summary returns the aggregate counters of the responses.
+// It should not be called concurrently.
+func (rs *ResponseMap) Summary() Summary {
+	return Summary{
+		Total:            len(rs.Map),
+		Failed:           rs.failed,
+		SLAViolations:    rs.slaViolations,
+		ServerErrors:     rs.serverErrors,
+		Lines:            rs.inputs[inputFetched] + rs.inputs[inputInvalid] + rs.inputs[inputDuplicate] + rs.inputs[inputDenied],
+		Fetched:          rs.inputs[inputFetched],
+		SkippedInvalid:   rs.inputs[inputInvalid],
+		SkippedDuplicate: rs.inputs[inputDuplicate],
+		Denied:           rs.inputs[inputDenied],
+		Filtered:         rs.filtered,
+		Attachments:      rs.attachments,
+		QueueWait:        rs.queueWait,
+	}
+}
+
+// Keys returns the URLs of the response map in the order.
+// It should not be called concurrently.
+func (rs *ResponseMap) Keys(order OutputOrder) []string {
+	var keys []string
+	switch order {
+	case OrderInput:
+		keys = append(keys, rs.created...)
+	case OrderCompletion:
+		keys = append(keys, rs.completed...)
+		// URLs that have not responded are written last.
+		for _, key := range rs.created {
+			if v := rs.Map[key]; v.Response == nil && v.Error == nil {
+				keys = append(keys, key)
+			}
+		}
+	default:
+		for key := range rs.Map {
+			keys = append(keys, key)
+		}
+		if order == OrderURL {
+			sort.Strings(keys)
+		}
+	}
+	return keys
+}
+
 // Len returns length of the response map.
 // It should not be called concurrently.
 func (rs *ResponseMap) Len() int {
@@ -74,127 +336,1307 @@ func (rs *ResponseMap) Len() int {
 }
 
 type HTTPHandler struct {
+	// requestTimeout is a time.Duration accessed atomically, so it can be changed while serving.
+	// It is the first field to be 64-bit aligned.
+	requestTimeout int64
 	requestLocks   chan struct{}
-	requestTimeout time.Duration
+	skipInvalid    bool
+	partialStatus  int
+	authUsername   string
+	authPassword   string
+	hostLimit      int
+	hostLocksMu    sync.Mutex
+	hostLocks      map[string]*hostLock
+	audit          bool
+	acceptFallback OutputMode
+	strictAccept   bool
+	slaThreshold   time.Duration
+	defaultScheme  string
+	buffers        *bufferPool
+	collectTrace   bool
+	retryBudget    float64
+	schemeTimeouts map[string]time.Duration
+	paused         int32
+	verifyDigest   bool
+	maxHeaders     int
+	maxHeaderBytes int
+	publications   chan publication
+	client         *http.Client
+	baseClient     *http.Client
+	transportOpts  [numTransportOptions]transportOption
+	reportHops     bool
+	workers        *workerPool
+	echoHeaders    bool
+	unredacted     map[string]bool
+	maxServerErrs  int
+	allowFileRefs  bool
+	allowedDir     string
+	outputOrder    OutputOrder
+	noKeepAlive    map[string]bool
+	advertise      bool
+	groupByOutcome bool
+	requiredPrefix *urlPrefix
+	downloadTypes  []string
+	captureCookies bool
+	cookieValues   bool
+	useCookieJar   bool
+	sequential     bool
+	injection      *failureInjection
+	countWire      bool
+	groupByHash    bool
+	sinkFactory    func(url string) io.WriteCloser
+	modeTimeouts   map[OutputMode]time.Duration
+	atomic         bool
+	drainGrace     time.Duration
+	sessions       *sessionStore
+	repeatDups     bool
+	rewriter       func(*url.URL) *url.URL
+	previewBytes   int
+	batchETags     bool
+	validator      func(url string, r Response) error
+	requireType    bool
+	statusColumn   bool
+	durations      bool
+	decompress     bool
+	hashAlgo       func() hash.Hash
+	logger         RequestLogger
+	onRequest      func(status int, duration time.Duration, err error)
+	onBatch        func(summary Summary, duration time.Duration, err error)
+	maxTimeout     time.Duration
+	resolver       *net.Resolver
+	smallReserve   chan struct{}
+	smallThreshold int
+	maxBodySize    int64
+	batchTimeout   time.Duration
+	queueTimeout   time.Duration
+	retryAfter     time.Duration
+	serverTiming   bool
+	collapseWWW    bool
+	method         string
+	maxRedirects   int
+	httpsFallback  bool
+	computeEntropy bool
+	retries        int
+	retryBackoff   time.Duration
+	forwardHeaders []string
+	userAgent      string
+	maxRatio       float64
+	trailers       bool
+	allowedHosts   []string
+	deniedHosts    []string
+	sizeRange      *sizeRange
+	schedules      scheduleStore
+	schemes        map[string]bool
+	// detectAttachments is set if the responses with the attachment disposition are marked.
+	detectAttachments bool
 }
 
-// NewHTTPHandler creates a handler with the default limit of 100 simultaneous requests
-func NewHTTPHandler() *HTTPHandler {
-	return NewHTTPHandlerWithRequestLimit(100)
+// hostLock limits the number of simultaneous requests to a single host.
+// It is removed from the handler once no request references it.
+type hostLock struct {
+	slots chan struct{}
+	refs  int
+}
+
+// NewHTTPHandler creates a handler with the default limit of 100 simultaneous requests,
+// configured with the options applied in order
+func NewHTTPHandler(opts ...Option) *HTTPHandler {
+	h := NewHTTPHandlerWithRequestLimit(100)
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // NewHTTPHandlerWithRequestLimit creates a handler with the user-defined limit of simultaneous requests
 func NewHTTPHandlerWithRequestLimit(limit int) *HTTPHandler {
 	return &HTTPHandler{
 		requestLocks:   make(chan struct{}, limit),
-		requestTimeout: time.Second,
+		requestTimeout: int64(time.Second),
+		partialStatus:  http.StatusMultiStatus,
+		buffers:        newBufferPool(0),
+		client:         http.DefaultClient,
+		baseClient:     http.DefaultClient,
+		outputOrder:    OrderInput,
+		method:         http.MethodGet,
+		maxRedirects:   -1,
+		schemes:        map[string]bool{"http": true, "https": true},
 	}
 }
 
-// SetRequestTimeout sets the timeout for each single request in the list
+// SetRequestTimeout sets the timeout for each single request in the list.
+// It is safe to call while the handler is serving requests, e.g. to adjust the timeout to the load;
+// the requests already started keep their timeout.
 func (h *HTTPHandler) SetRequestTimeout(timeout time.Duration) {
-	h.requestTimeout = timeout
+	atomic.StoreInt64(&h.requestTimeout, int64(timeout))
+}
+
+// SetMaxRequestTimeout sets the maximum request timeout a batch may set with the X-Request-Timeout header
+// or the timeout option. A batch setting a longer timeout is rejected with 400 Bad Request.
+// Zero, which is the default, allows any timeout.
+func (h *HTTPHandler) SetMaxRequestTimeout(timeout time.Duration) {
+	h.maxTimeout = timeout
+}
+
+// defaultTimeout returns the request timeout set with SetRequestTimeout.
+func (h *HTTPHandler) defaultTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.requestTimeout))
+}
+
+// SetMethod sets the HTTP method of the requests, GET by default. It can be overridden for a single
+// batch with the method option. The size of the responses to HEAD requests is taken from Content-Length.
+func (h *HTTPHandler) SetMethod(method string) error {
+	if !batchMethods[method] {
+		return fmt.Errorf("unsupported method %s", method)
+	}
+	h.method = method
+	return nil
+}
+
+// SetBatchTimeout bounds the total time of each batch. When the timeout expires, the requests still
+// in flight are cancelled and fail, and the responses received so far are written.
+// The timeouts set with SetModeTimeout take precedence for their output modes. Zero removes the bound.
+func (h *HTTPHandler) SetBatchTimeout(timeout time.Duration) {
+	h.batchTimeout = timeout
+}
+
+// SetTimeoutDrainGrace sets the grace period requests are given after their timeout to finish receiving
+// the response. A request that has not completed before its timeout still fails, but its connection
+// is closed only if the response does not finish arriving within the grace period, so it can be reused
+// by the following requests. The grace period only applies once the response headers have arrived.
+// This saves reestablishing expensive connections, e.g. TLS ones, at the cost of holding each timed-out
+// request for up to the grace period longer. Zero disables draining.
+func (h *HTTPHandler) SetTimeoutDrainGrace(grace time.Duration) {
+	h.drainGrace = grace
+}
+
+// SetSchemeTimeout sets the request timeout for the URLs with the given scheme,
+// overriding the timeout set by SetRequestTimeout. Zero removes the override.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetSchemeTimeout(scheme string, timeout time.Duration) {
+	scheme = strings.ToLower(scheme)
+	if timeout <= 0 {
+		delete(h.schemeTimeouts, scheme)
+		return
+	}
+	if h.schemeTimeouts == nil {
+		h.schemeTimeouts = make(map[string]time.Duration)
+	}
+	h.schemeTimeouts[scheme] = timeout
+}
+
+// timeoutFor returns the request timeout for the URL.
+func (h *HTTPHandler) timeoutFor(urlString string) time.Duration {
+	scheme, _, _ := strings.Cut(urlString, ":")
+	if timeout, ok := h.schemeTimeouts[strings.ToLower(scheme)]; ok {
+		return timeout
+	}
+	return h.defaultTimeout()
+}
+
+// SetPartialStatusCode sets the status code returned when some of the requests have failed.
+// The default is 207 Multi-Status. The code must allow a response body.
+func (h *HTTPHandler) SetPartialStatusCode(code int) error {
+	if code < 200 || code > 599 || code == http.StatusNoContent || code == http.StatusNotModified {
+		return fmt.Errorf("invalid partial status code %d", code)
+	}
+	h.partialStatus = code
+	return nil
+}
+
+// SetAtomic sets whether the batch succeeds or fails as a whole. When enabled, a batch with any failed
+// request is rejected with 424 Failed Dependency and no sizes, instead of a partial result.
+func (h *HTTPHandler) SetAtomic(enabled bool) {
+	h.atomic = enabled
+}
+
+// SetEndpointAuth enables HTTP Basic authentication of incoming requests.
+// Requests without valid credentials are rejected with 401 Unauthorized before any work is done.
+// An empty username disables authentication.
+func (h *HTTPHandler) SetEndpointAuth(username, password string) {
+	h.authUsername = username
+	h.authPassword = password
+}
+
+// SetGlobalPerHostLimit sets the maximum number of simultaneous requests to a single host.
+// The limit is shared by all the batches served by the handler. Requests over the limit wait
+// for a free slot within their timeout. Zero disables the limit.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetGlobalPerHostLimit(limit int) {
+	h.hostLimit = limit
+}
+
+// SetCompressionAudit enables the compression audit. When enabled, gzip encoding is requested
+// explicitly and both the received (compressed) and the decompressed body sizes are recorded.
+// The decompressed size is reported.
+func (h *HTTPHandler) SetCompressionAudit(enabled bool) {
+	h.audit = enabled
+}
+
+// SetSLAThreshold sets the response time after which a successful response is marked as SLA violated.
+// The threshold should be shorter than the request timeout. Zero disables the check.
+func (h *HTTPHandler) SetSLAThreshold(threshold time.Duration) {
+	h.slaThreshold = threshold
+}
+
+// SetDefaultScheme sets the scheme prepended to URLs listed without one, e.g. "https".
+// The prefixed URL is fetched and reported. By default URLs without a scheme are invalid.
+func (h *HTTPHandler) SetDefaultScheme(scheme string) {
+	h.defaultScheme = scheme
+}
+
+// hasScheme reports whether the URL starts with a scheme followed by "://".
+// A "://" in the path, query or fragment does not count.
+func hasScheme(urlString string) bool {
+	i := strings.Index(urlString, "://")
+	return i >= 0 && !strings.ContainsAny(urlString[:i], "/?#")
+}
+
+// SetCopyMemoryBudget limits the total memory of the buffers used to read response bodies
+// across all the requests in flight. When the budget is exhausted, requests wait for a buffer
+// within their timeout. The budget is rounded down to the 32 KiB buffer size, but at least
+// one buffer is always available. Zero disables the limit.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetCopyMemoryBudget(budget int64) {
+	h.buffers = newBufferPool(budget)
+}
+
+// SetBodySinkFactory sets the factory of the writers each response body is streamed to while it is counted,
+// e.g. to archive the bodies. The factory is called with the URL as listed in the request once its response
+// headers are received, and may return nil to skip the URL. The sink is closed once the body is read or
+// reading it has failed. A failed write fails the request. Nil disables the sinks.
+func (h *HTTPHandler) SetBodySinkFactory(factory func(url string) io.WriteCloser) {
+	h.sinkFactory = factory
+}
+
+// SetTraceCollection enables collection of connection details for each request,
+// such as the IP address the URL was resolved to.
+func (h *HTTPHandler) SetTraceCollection(enabled bool) {
+	h.collectTrace = enabled
+}
+
+// SetMaxBodySize limits the number of bytes read from each response body. Reading stops once
+// the limit is reached, and if the body is longer, its Size is the limit and it is marked with BodyTruncated.
+// The size of the compressed bodies is limited after decompression if the compression audit is enabled.
+// Zero disables the limit.
+func (h *HTTPHandler) SetMaxBodySize(n int64) {
+	h.maxBodySize = n
+}
+
+// SetMaxCapturedHeaders limits the response headers retained for each URL after the response is read.
+// Headers are kept in the order of their canonical names until either the count of names or the total
+// size of names and values would exceed the limits; the rest are dropped and the response is marked
+// with HeadersTruncated. Zero disables the corresponding limit.
+func (h *HTTPHandler) SetMaxCapturedHeaders(count, size int) {
+	h.maxHeaders = count
+	h.maxHeaderBytes = size
+}
+
+// truncateHeaders drops the response headers exceeding the captured headers limits.
+func (h *HTTPHandler) truncateHeaders(resp *Response) {
+	if h.maxHeaders <= 0 && h.maxHeaderBytes <= 0 {
+		return
+	}
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	captured := make(http.Header)
+	size := 0
+	for _, name := range names {
+		entrySize := len(name)
+		for _, value := range resp.Header[name] {
+			entrySize += len(value)
+		}
+		if (h.maxHeaders > 0 && len(captured) == h.maxHeaders) ||
+			(h.maxHeaderBytes > 0 && size+entrySize > h.maxHeaderBytes) {
+			resp.HeadersTruncated = true
+			break
+		}
+		captured[name] = resp.Header[name]
+		size += entrySize
+	}
+	resp.Header = captured
+}
+
+// SetReportRedirectHops sets whether each redirect is reported as a separate entry.
+// When enabled, the response of every redirect is recorded under the URL that was redirected,
+// and the final response is recorded under the URL the request ended up with, so a URL redirected
+// twice produces three entries. Entries for URLs that are already reported are not overwritten.
+func (h *HTTPHandler) SetReportRedirectHops(enabled bool) {
+	h.reportHops = enabled
+}
+
+// SetMaxServerErrors sets the number of responses with 5xx status codes after which the batch is aborted.
+// The requests in flight are cancelled and the handler responds with 502 Bad Gateway.
+// Zero disables the limit.
+func (h *HTTPHandler) SetMaxServerErrors(n int) {
+	h.maxServerErrs = n
+}
+
+// SetAdvertiseLimits sets whether the effective limits of the handler are sent to the clients
+// in the X-Handler-Limits header of every response, e.g.
+// "concurrency=100, request-timeout=1s, per-host=10, workers=50".
+// Limits that are not set are omitted.
+func (h *HTTPHandler) SetAdvertiseLimits(enabled bool) {
+	h.advertise = enabled
+}
+
+// limits formats the effective limits of the handler.
+func (h *HTTPHandler) limits() string {
+	limits := []string{
+		fmt.Sprintf("concurrency=%d", cap(h.requestLocks)),
+		fmt.Sprintf("request-timeout=%s", h.defaultTimeout()),
+	}
+	if h.batchTimeout > 0 {
+		limits = append(limits, fmt.Sprintf("batch-timeout=%s", h.batchTimeout))
+	}
+	if h.queueTimeout > 0 {
+		limits = append(limits, fmt.Sprintf("queue-timeout=%s", h.queueTimeout))
+	}
+	if h.hostLimit > 0 {
+		limits = append(limits, fmt.Sprintf("per-host=%d", h.hostLimit))
+	}
+	if h.workers != nil {
+		limits = append(limits, fmt.Sprintf("workers=%d", h.workers.size))
+	}
+	if h.smallReserve != nil {
+		limits = append(limits, fmt.Sprintf("small-reserve=%d/%d", cap(h.smallReserve), h.smallThreshold))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// SetRequiredURLPrefix sets the prefix all the URLs of a batch must start with, e.g. "https://example.com/api/".
+// The URLs are compared with the prefix after parsing: the scheme and the host must be equal, and the path
+// must be within the path of the prefix by whole segments, so e.g. https://example.com.evil.net/ does not
+// match https://example.com. A prefix may also consist of the scheme only, e.g. "https://".
+// A URL without the prefix is invalid: it aborts the batch or, if invalid URLs are skipped, is skipped.
+// An empty prefix disables the check.
+func (h *HTTPHandler) SetRequiredURLPrefix(prefix string) error {
+	if prefix == "" {
+		h.requiredPrefix = nil
+		return nil
+	}
+	u, err := url.Parse(prefix)
+	if err != nil || u.Scheme == "" || u.User != nil {
+		return fmt.Errorf("invalid URL prefix %q", prefix)
+	}
+	h.requiredPrefix = &urlPrefix{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Host),
+		path:   strings.TrimSuffix(u.Path, "/"),
+	}
+	return nil
+}
+
+// urlPrefix is the parsed required URL prefix. Empty parts match any URL.
+type urlPrefix struct {
+	scheme string
+	host   string
+	path   string
+}
+
+// match reports whether the URL is within the prefix.
+func (p *urlPrefix) match(u *url.URL) bool {
+	if p == nil {
+		return true
+	}
+	if u.Scheme != p.scheme || (p.host != "" && (u.User != nil || strings.ToLower(u.Host) != p.host)) {
+		return false
+	}
+	if p.path == "" {
+		return true
+	}
+	// Dot segments are resolved, so that the URL cannot leave the path of the prefix.
+	cleaned := path.Clean("/" + u.Path)
+	return cleaned == p.path || strings.HasPrefix(cleaned, p.path+"/")
+}
+
+// SetAllowedSchemes sets the URL schemes that can be requested, http and https by default.
+// A URL with another scheme, e.g. file or ftp, is invalid like a URL without the required prefix.
+func (h *HTTPHandler) SetAllowedSchemes(schemes []string) {
+	h.schemes = make(map[string]bool, len(schemes))
+	for _, scheme := range schemes {
+		h.schemes[strings.ToLower(scheme)] = true
+	}
+}
+
+// SetDownloadContentTypeFilter sets the content types whose bodies are downloaded, e.g. "application/json"
+// or "image/*". When set, the headers of each URL are requested with HEAD first, and the body is only
+// requested if the content type matches. Other responses are marked with BodySkipped.
+// An empty filter downloads all the bodies with a single request.
+func (h *HTTPHandler) SetDownloadContentTypeFilter(contentTypes []string) {
+	h.downloadTypes = nil
+	for _, contentType := range contentTypes {
+		h.downloadTypes = append(h.downloadTypes, strings.ToLower(contentType))
+	}
+}
+
+// SetURLRewriter sets the function rewriting each valid URL before it is fetched, e.g. to map a host name
+// to an internal address. The responses are still recorded under the URL as it was listed.
+// The rewriter receives a parsed copy of the URL; returning nil rejects the URL with ErrURLRejected.
+func (h *HTTPHandler) SetURLRewriter(rewriter func(*url.URL) *url.URL) {
+	h.rewriter = rewriter
 }
 
-func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// SetResponseValidator sets the function checking each successful response after it is read,
+// e.g. its status code, headers or size. If it returns an error, the URL is recorded as failed with it.
+// The validator is called concurrently from the goroutines performing the requests.
+func (h *HTTPHandler) SetResponseValidator(validator func(url string, r Response) error) {
+	h.validator = validator
+}
+
+// sizeRange is the inclusive range of acceptable response sizes.
+type sizeRange struct {
+	min, max int64
+}
+
+// SetAcceptableSizeRange sets the inclusive range of the acceptable response sizes, e.g. for contract
+// testing endpoints that should all return bodies of a similar size. A successful response whose size
+// is outside of the range is recorded as failed with ErrSizeOutOfRange. The check is done before
+// the response validator set with SetResponseValidator.
+func (h *HTTPHandler) SetAcceptableSizeRange(min, max int64) error {
+	if min < 0 || max < min {
+		return fmt.Errorf("invalid size range %d-%d", min, max)
+	}
+	h.sizeRange = &sizeRange{min: min, max: max}
+	return nil
+}
+
+// checkSize returns ErrSizeOutOfRange if the size of the response is outside of the acceptable range.
+func (h *HTTPHandler) checkSize(r Response) error {
+	if h.sizeRange == nil || (r.Size >= h.sizeRange.min && r.Size <= h.sizeRange.max) {
+		return nil
+	}
+	return fmt.Errorf("%w: %d bytes, expected %d-%d", ErrSizeOutOfRange, r.Size, h.sizeRange.min, h.sizeRange.max)
+}
+
+// SetRequireContentType sets whether a 2xx response without the Content-Type header is recorded
+// as failed with ErrMissingContentType, e.g. to catch misconfigured servers when auditing an API.
+func (h *HTTPHandler) SetRequireContentType(enabled bool) {
+	h.requireType = enabled
+}
+
+// checkContentType returns ErrMissingContentType if the Content-Type header is required and the 2xx response has none.
+func (h *HTTPHandler) checkContentType(r Response) error {
+	if !h.requireType || r.Response == nil || r.StatusCode < 200 || r.StatusCode > 299 || r.Header.Get("Content-Type") != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %d response", ErrMissingContentType, r.StatusCode)
+}
+
+// SetSequential sets whether the URLs of a batch are fetched one at a time in input order,
+// each request starting after the previous one has completed, instead of concurrently.
+// It makes the cookie jar set with SetUseCookieJar deterministic.
+func (h *HTTPHandler) SetSequential(enabled bool) {
+	h.sequential = enabled
+}
+
+// SetSkipInvalid sets whether invalid URLs in the request body are skipped.
+// By default an invalid URL aborts the whole batch with 400 Bad Request.
+func (h *HTTPHandler) SetSkipInvalid(skip bool) {
+	h.skipInvalid = skip
+}
+
+// Pause stops the handler from accepting new batches. Requests are rejected with 503 Service Unavailable,
+// with the Retry-After header set by SetRetryAfter, until Resume is called, while batches in flight
+// complete normally. It is safe to call concurrently.
+func (h *HTTPHandler) Pause() {
+	atomic.StoreInt32(&h.paused, 1)
+}
+
+// Resume makes the paused handler accept new batches again. It is safe to call concurrently.
+func (h *HTTPHandler) Resume() {
+	atomic.StoreInt32(&h.paused, 0)
+}
+
+// ServeHTTP fetches the batch of URLs listed in the request and writes their sizes.
+// All the checks that can reject the request are done before its body is read, so that a client
+// sending "Expect: 100-continue" receives the final status instead of 100 Continue and does not
+// upload the list. Otherwise the server sends 100 Continue once the list starts being read,
+// or when the handler is busy and the small request reserve counts the listed URLs.
+func (h *HTTPHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &headerTracker{ResponseWriter: rw}
+	defer h.recoverPanic(w, r)
+	if h.advertise {
+		w.Header().Set("X-Handler-Limits", h.limits())
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="httphandler", charset="UTF-8"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if id, ok := h.sessionSummaryID(r); ok {
+		h.writeSessionSummary(w, id)
+		return
+	}
+	if id, ok := scheduleResultsID(r); ok {
+		h.writeScheduleResults(w, id)
+		return
+	}
+	if r.Method != http.MethodPost && !isQueryBatch(r) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	select {
-	case h.requestLocks <- struct{}{}:
-		defer func() { <-h.requestLocks }()
-		resps, err := h.executeAllRequests(r)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+	if atomic.LoadInt32(&h.paused) != 0 {
+		h.writeRetryAfter(w)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	mode, ok := negotiateOutput(r.Header.Get("Accept"), h.acceptFallback)
+	if !ok {
+		if h.strictAccept {
+			w.WriteHeader(http.StatusNotAcceptable)
 			return
 		}
-		h.writeResponse(w, resps)
-	default:
+		mode = h.acceptFallback
+	}
+	var release func()
+	queued := time.Now()
+	r, release, ok = h.acquireRequest(r)
+	wait := time.Since(queued)
+	h.writeServerTiming(w, wait)
+	if !ok {
+		h.writeRetryAfter(w)
 		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	ctx := context.WithValue(r.Context(), queueWaitKey{}, wait)
+	if timeout := h.batchTimeoutFor(mode); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resps, err := h.executeAllRequests(r.WithContext(ctx))
+	if r.Context().Err() != nil {
+		// The client has gone away, all the requests were cancelled
+		// and there is nobody to write the response to.
+		return
+	}
+	if errors.Is(err, ErrTooManyServerErrors) {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	h.recordSession(r, resps)
+	h.writeResponse(w, r, resps, mode)
+}
+
+// acquireRequest takes a request slot, or a reserved slot if the batch is small.
+// If neither is free, it waits for a request slot until the queue timeout expires.
+// The returned request replaces r, since a part of its body may have been read ahead.
+func (h *HTTPHandler) acquireRequest(r *http.Request) (req *http.Request, release func(), ok bool) {
+	select {
+	case h.requestLocks <- struct{}{}:
+		return r, func() { <-h.requestLocks }, true
+	default:
+	}
+	if r, release, ok = h.acquireSmall(r); ok {
+		return r, release, true
+	}
+	release, ok = h.waitRequest(r)
+	return r, release, ok
+}
+
+// recoverPanic logs the panic raised while serving the request and responds with 500 Internal Server Error,
+// unless the header has already been written. The request slot is released by the deferred call
+// in ServeHTTP before the panic gets here.
+func (h *HTTPHandler) recoverPanic(w *headerTracker, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+	log.Printf("httphandler: panic serving %s: %v\n%s", r.RemoteAddr, p, debug.Stack())
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// headerTracker is a response writer recording whether the header has been written.
+type headerTracker struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (ht *headerTracker) WriteHeader(code int) {
+	ht.wroteHeader = true
+	ht.ResponseWriter.WriteHeader(code)
+}
+
+func (ht *headerTracker) Write(p []byte) (int, error) {
+	ht.wroteHeader = true
+	return ht.ResponseWriter.Write(p)
+}
+
+// recoverRequest records the panic raised while performing the request to the URL, e.g. in the validator,
+// the rewriter or a callback, as its error instead of crashing the process. If the response of the URL
+// has already been recorded, the panic is only logged.
+func (h *HTTPHandler) recoverRequest(b *batch, url string, p interface{}) {
+	if p == nil {
+		return
+	}
+	log.Printf("httphandler: panic fetching %s: %v\n%s", url, p, debug.Stack())
+	b.resps.SetResponse(url, Response{Error: fmt.Errorf("%w: %v", ErrRequestPanic, p)})
+}
+
+// authorized checks the Basic authentication credentials of the request.
+// It always succeeds if endpoint authentication is not configured.
+func (h *HTTPHandler) authorized(r *http.Request) bool {
+	if h.authUsername == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(h.authUsername)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(h.authPassword)) == 1
+	return usernameMatch && passwordMatch
 }
 
 // writeResponse formats the response and sets the status code.
 // Status codes:
 //  200 — All of the requested URL have responded.
-//  207 — Some of the requests have failed.
+//  207 — Some of the requests have failed (configurable with SetPartialStatusCode).
+//  424 — Some of the requests have failed and the batch is atomic.
+//  304 — The result has not changed since the entity tag in If-None-Match.
 //  408 — None of the requests were successful.
-func (h *HTTPHandler) writeResponse(w http.ResponseWriter, resps *ResponseMap) {
+// HTTP/1.0 clients do not support chunked encoding, so their response is buffered
+// and sent with the Content-Length header.
+func (h *HTTPHandler) writeResponse(w http.ResponseWriter, r *http.Request, resps *ResponseMap, mode OutputMode) {
 	if resps.AllFailed() {
 		w.WriteHeader(http.StatusRequestTimeout)
 		return
 	}
+	status := h.partialStatus
 	if resps.AllSuccessful() {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusMultiStatus)
-	}
-	for _, resp := range resps.Map {
-		respString := "-1\n"
-		if resp.Response != nil {
-			body, err := h.readResponse(resp)
-			if err != nil {
-				panic(err)
-			}
-			respString = fmt.Sprintln(len(body))
-		}
-		_, err := w.Write([]byte(respString))
-		if err != nil {
+		status = http.StatusOK
+	} else if h.atomic {
+		w.WriteHeader(http.StatusFailedDependency)
+		return
+	}
+	if h.writeNotModified(w, r, resps, mode) {
+		return
+	}
+	if contentType := mode.contentType(); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if !r.ProtoAtLeast(1, 1) {
+		buf := bytes.NewBuffer(nil)
+		h.writeBody(buf, resps, mode)
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		h.writeTrailers(w, resps, status)
+		w.WriteHeader(status)
+		if _, err := w.Write(buf.Bytes()); err != nil {
 			panic(err)
 		}
+		return
 	}
+	h.declareTrailers(w)
+	w.WriteHeader(status)
+	h.writeBody(w, resps, mode)
+	h.writeTrailers(w, resps, status)
 }
 
-// readResponse reads the response body and closes it.
-func (h *HTTPHandler) readResponse(resp Response) (body []byte, err error) {
+// writeBody writes the responses in the output mode.
+func (h *HTTPHandler) writeBody(w io.Writer, resps *ResponseMap, mode OutputMode) {
+	switch mode {
+	case OutputPrometheus:
+		h.writePrometheus(w, resps)
+	case OutputTSV:
+		h.writeTSV(w, resps)
+	case OutputJSON:
+		h.writeJSON(w, resps)
+	case OutputFrames:
+		h.writeFrames(w, resps)
+	default:
+		h.writeText(w, resps)
+	}
+}
+
+// readResponse reads the response body, records its size and closes it.
+// If sink is not nil, the body is streamed to it as it is read.
+func (h *HTTPHandler) readResponse(ctx context.Context, resp *Response, sink io.Writer) error {
 	defer resp.Body.Close()
-	body, err = ioutil.ReadAll(resp.Body)
+	buf, err := h.buffers.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer h.buffers.put(buf)
+	var digest *bodyDigest
+	// The body decoded by the transport is not the one the digest was computed over.
+	if h.verifyDigest && !resp.Uncompressed {
+		digest = expectedDigest(resp.Header)
+	}
+	wire := &countingReader{Reader: resp.Body}
+	if digest != nil {
+		wire.Reader = io.TeeReader(resp.Body, digest)
+	}
+	if resp.Request.Method == http.MethodHead {
+		// There is no body to read, the size is taken from the headers.
+		if resp.ContentLength > 0 {
+			resp.Size = resp.ContentLength
+		}
+		return nil
+	}
+	var reader io.Reader = wire
+	decoded, err := h.decodeBody(wire, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return err
+	}
+	if decoded != nil {
+		defer decoded.Close()
+		reader = decoded
+		if h.maxRatio > 0 {
+			reader = &ratioReader{decoded: countingReader{Reader: decoded}, compressed: wire, ratio: h.maxRatio}
+		}
+	}
+	untruncated := reader
+	if h.maxBodySize > 0 {
+		reader = io.LimitReader(reader, h.maxBodySize)
+	}
+	if sink != nil {
+		reader = io.TeeReader(reader, sink)
+	}
+	var preview *previewWriter
+	if h.previewBytes > 0 {
+		preview = newPreviewWriter(h.previewBytes)
+		reader = io.TeeReader(reader, preview)
+	}
+	bodyHash := h.newBodyHash()
+	if bodyHash != nil {
+		reader = io.TeeReader(reader, bodyHash)
+	}
+	var entropy *entropyWriter
+	if h.computeEntropy {
+		entropy = &entropyWriter{}
+		reader = io.TeeReader(reader, entropy)
+	}
+	resp.Size, err = discard(reader, *buf)
+	if preview != nil {
+		resp.Preview = preview.String()
+	}
+	if err != nil {
+		return err
+	}
+	if h.maxBodySize > 0 && resp.Size == h.maxBodySize {
+		var next [1]byte
+		_, err = io.ReadFull(untruncated, next[:])
+		resp.BodyTruncated = err == nil
+	}
+	if entropy != nil {
+		resp.Entropy = entropy.entropy()
+	}
+	if bodyHash != nil {
+		resp.BodyHash = hex.EncodeToString(bodyHash.Sum(nil))
+	}
+	if h.audit {
+		resp.WireSize = wire.n
+	}
+	if digest != nil && !resp.BodyTruncated {
+		if err = digest.verify(); err != nil {
+			return err
+		}
+		resp.DigestVerified = true
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.Reader.Read(p)
+	cr.n += int64(n)
 	return
 }
 
-// executeAllRequests iterates over the original request body and performs GET request for all the URLs listed.
+// Fetch performs request for each of the URLs like a batch served by the handler and returns the responses,
+// so the handler can be used without serving HTTP. All the handler options apply except for the ones of
+// the incoming requests, like the queue timeout, and the batch timeout bounds the call.
+// The call waits for a free request slot, sharing the concurrent request limit with the served batches.
+// It blocks until either all requests have responded, timed out or the context is cancelled.
+func (h *HTTPHandler) Fetch(ctx context.Context, urls []string) (*ResponseMap, error) {
+	if h.batchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.batchTimeout)
+		defer cancel()
+	}
+	select {
+	case h.requestLocks <- struct{}{}:
+		defer func() { <-h.requestLocks }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return h.executeBatch(ctx, batchConfig{method: h.method}, &listSource{urls: urls})
+}
+
+// executeAllRequests iterates over the URLs listed in the original request body, or in its query
+// for GET requests, and performs request for each of them. The body may start with a line of JSON options
+// applied to the requests of this batch only, e.g. {"timeout":"5s","method":"HEAD"}. The timeout
+// may also be set with the X-Request-Timeout header.
+// Requests are started as soon as their URL is scanned, so fetching overlaps with reading the body.
 // It blocks until either all requests have responded, timed out or the original request context is cancelled.
 func (h *HTTPHandler) executeAllRequests(r *http.Request) (resps *ResponseMap, err error) {
-	resps = NewResponseMap()
-	scanner := bufio.NewScanner(r.Body)
 	defer r.Body.Close()
-	for scanner.Scan() {
-		urlString := scanner.Text()
-		_, err = url.ParseRequestURI(urlString)
+	cfg := batchConfig{method: h.method, timeout: headerTimeout(r)}
+	var urls urlSource
+	if isQueryBatch(r) {
+		cfg, urls, err = parseQueryBatch(r.URL.Query(), cfg)
+		if err != nil {
+			return
+		}
+	} else {
+		var closer io.Closer
+		urls, closer, err = h.bodySource(r.Body, r.Header.Get("Content-Type"), &cfg)
 		if err != nil {
 			return
 		}
-		resps.Create(urlString)
+		defer closer.Close()
 	}
-	if resps.Len() == 0 {
-		err = errors.New("empty request body")
+	if h.maxTimeout > 0 && cfg.timeout > h.maxTimeout {
+		return nil, fmt.Errorf("timeout %s exceeds the maximum of %s", cfg.timeout, h.maxTimeout)
+	}
+	cfg.header = h.forwardedHeader(r)
+	return h.executeBatch(r.Context(), cfg, urls)
+}
+
+// executeBatch performs request for each URL of the source as soon as it is scanned.
+// If an invalid URL is met and skipping is disabled, requests already in flight are cancelled.
+func (h *HTTPHandler) executeBatch(ctx context.Context, cfg batchConfig, urls urlSource) (resps *ResponseMap, err error) {
+	if h.useCookieJar {
+		cfg.jar, _ = cookiejar.New(nil)
+	}
+	b := newBatch(ctx, cfg)
+	defer b.cancel()
+	b.resps.queueWait, _ = ctx.Value(queueWaitKey{}).(time.Duration)
+	if h.onBatch != nil {
+		start := time.Now()
+		defer func() { h.onBatch(b.resps.Summary(), time.Since(start), err) }()
+	}
+	b.budget = newRetryBudget(h.retryBudget)
+	resps = b.resps
+	// firstURLs maps the dedup keys to the first URL listed with them.
+	firstURLs := make(map[string]string)
+	for b.ctx.Err() == nil && urls.Scan() {
+		urlString := urls.Text()
+		if h.defaultScheme != "" && !hasScheme(urlString) {
+			urlString = h.defaultScheme + "://" + urlString
+		}
+		err = h.validateURL(urlString)
+		if err != nil {
+			if errors.Is(err, ErrURLPrefixMismatch) {
+				resps.countInput(inputDenied)
+			} else {
+				resps.countInput(inputInvalid)
+			}
+			if h.skipInvalid {
+				err = nil
+				continue
+			}
+			b.cancel()
+			b.wg.Wait()
+			return
+		}
+		if key := h.dedupKey(urlString); key != "" {
+			if first, ok := firstURLs[key]; ok {
+				resps.countDuplicate(first)
+				continue
+			}
+			firstURLs[key] = urlString
+		}
+		if err = resps.Create(urlString); errors.Is(err, ErrDuplicateURL) {
+			// Duplicates are collapsed into the first occurrence, which is the only one fetched.
+			resps.countDuplicate(urlString)
+			err = nil
+			continue
+		} else if err != nil {
+			b.cancel()
+			b.wg.Wait()
+			return
+		}
+		resps.countInput(inputFetched)
+		b.budget.addRequest()
+		b.wg.Add(1)
+		if h.sequential {
+			h.executeRequest(b, urlString)
+			continue
+		}
+		err = h.run(b.ctx, func() { h.executeRequest(b, urlString) })
+		if err != nil {
+			resps.SetResponse(urlString, Response{Error: err})
+			b.wg.Done()
+			err = nil
+		}
+	}
+	if err = urls.Err(); err != nil {
+		b.cancel()
+		b.wg.Wait()
 		return
 	}
-	wg := new(sync.WaitGroup)
-	wg.Add(resps.Len())
-	for url := range resps.Map {
-		go h.executeRequest(r.Context(), url, resps, wg)
+	b.wg.Wait()
+	if err = b.abortErr(); err != nil {
+		return
+	}
+	if resps.Len() == 0 {
+		err = errors.New("empty URL list")
 	}
-	wg.Wait()
 	return
 }
 
-// executeRequest performs request on a single URL.
-// It blocks until response is received, request have timed out or the original request context is cancelled.
-func (h *HTTPHandler) executeRequest(pctx context.Context, url string, resps *ResponseMap, wg *sync.WaitGroup) {
-	defer wg.Done()
-	ctx, cancel := context.WithTimeout(pctx, h.requestTimeout)
+// validateURL checks that the URL can be requested by the handler.
+func (h *HTTPHandler) validateURL(urlString string) error {
+	u, err := url.ParseRequestURI(urlString)
+	if err != nil {
+		return err
+	}
+	if !h.schemes[u.Scheme] {
+		return fmt.Errorf("%w: %s", ErrSchemeNotAllowed, urlString)
+	}
+	if !h.requiredPrefix.match(u) {
+		return fmt.Errorf("%w: %s", ErrURLPrefixMismatch, urlString)
+	}
+	return nil
+}
+
+// SetCollapseWWW sets whether URLs differing only by the "www." prefix of their host are treated
+// as duplicates, e.g. http://example.com/ and http://www.example.com/. Only the first of them is fetched
+// and reported under the URL as it was listed. This is a heuristic: hosts with and without the prefix
+// may serve genuinely different sites, which are then collapsed as well.
+func (h *HTTPHandler) SetCollapseWWW(enabled bool) {
+	h.collapseWWW = enabled
+}
+
+// dedupKey returns the key the URL is deduplicated by, or an empty string if only identical URLs are duplicates.
+func (h *HTTPHandler) dedupKey(urlString string) string {
+	if !h.collapseWWW {
+		return ""
+	}
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return ""
+	}
+	u.Host = strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	return u.String()
+}
+
+// executeRequest performs request on a single URL of the batch, records and publishes the response.
+// It blocks until response is read, request have timed out or the batch context is cancelled.
+func (h *HTTPHandler) executeRequest(b *batch, url string) {
+	defer b.wg.Done()
+	defer func() { h.recoverRequest(b, url, recover()) }()
+	r, injected := h.injection.inject()
+	var hops []redirectHop
+	if !injected {
+		target, err := h.rewriteURL(url)
+		if err == nil {
+			err = h.checkHost(target)
+		}
+		if err != nil {
+			r = Response{Error: err}
+		} else {
+			r, hops = h.fetchWithRetries(b, target)
+			if len(hops) > 0 {
+				// The first hop is recorded under the URL as it was listed.
+				hops[0].url = url
+			}
+		}
+		if errors.Is(r.Error, ErrHostNotAllowed) || errors.Is(r.Error, ErrBlockedAddress) {
+			b.resps.countDenied()
+		}
+	}
+	h.recordCookies(&r, b.cfg.jar)
+	for _, hop := range hops {
+		h.recordCookies(&hop.resp, b.cfg.jar)
+		b.resps.SetResponse(hop.url, hop.resp)
+		h.publish(hop.url, hop.resp)
+		h.reportRequest(hop.url, hop.resp)
+	}
+	if len(hops) > 0 {
+		url = hops[len(hops)-1].location
+	}
+	if r.Error == nil {
+		r.Error = h.checkSize(r)
+	}
+	if r.Error == nil {
+		r.Error = h.checkContentType(r)
+	}
+	if h.validator != nil && r.Error == nil {
+		r.Error = h.validator(url, r)
+	}
+	b.resps.SetResponse(url, r)
+	h.publish(url, r)
+	h.reportRequest(url, r)
+	if h.maxServerErrs > 0 && b.resps.serverErrorCount() > h.maxServerErrs {
+		b.abort(ErrTooManyServerErrors)
+	}
+}
+
+// rewriteURL applies the URL rewriter, if set, to the URL before it is fetched.
+func (h *HTTPHandler) rewriteURL(rawURL string) (string, error) {
+	if h.rewriter == nil {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u = h.rewriter(u); u == nil {
+		return "", fmt.Errorf("%w: %s", ErrURLRejected, rawURL)
+	}
+	return u.String(), nil
+}
+
+// redirectHop is an intermediate response of a redirected request.
+type redirectHop struct {
+	url      string
+	location string
+	resp     Response
+}
+
+// fetchFiltered performs request on a single URL in two phases if the download content type filter is set
+// and the body is requested with GET. First the headers are requested with HEAD, and the body is only
+// downloaded if the content type matches the filter. If the server does not support HEAD, the body
+// is downloaded without filtering.
+func (h *HTTPHandler) fetchFiltered(ctx context.Context, url string, cfg batchConfig, deadline time.Time) (r Response, hops []redirectHop) {
+	if len(h.downloadTypes) == 0 || cfg.method != http.MethodGet {
+		return h.fetch(ctx, url, cfg, deadline)
+	}
+	headCfg := cfg
+	headCfg.method = http.MethodHead
+	r, hops = h.fetch(ctx, url, headCfg, deadline)
+	if r.Error != nil || r.StatusCode == http.StatusMethodNotAllowed || r.StatusCode == http.StatusNotImplemented ||
+		h.matchDownloadType(r.Header.Get("Content-Type")) {
+		return h.fetch(ctx, url, cfg, deadline)
+	}
+	r.BodySkipped = true
+	return r, hops
+}
+
+// matchDownloadType reports whether the content type matches the download content type filter.
+func (h *HTTPHandler) matchDownloadType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, filter := range h.downloadTypes {
+		if filter == mediaType || (strings.HasSuffix(filter, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(filter, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch performs request on a single URL and reads the response body.
+// If redirect hops are reported, the intermediate responses are returned as hops.
+// The response must be received before the deadline of the URL, shared by all its attempts.
+func (h *HTTPHandler) fetch(pctx context.Context, url string, cfg batchConfig, deadline time.Time) (r Response, hops []redirectHop) {
+	ctx, cancel := context.WithDeadline(pctx, deadline.Add(h.drainGrace))
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	// The drain grace only extends reading the body, the headers must arrive before the deadline.
+	headersLate := func() bool { return false }
+	if h.drainGrace > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithCancel(ctx)
+		defer stop()
+		timer := time.AfterFunc(time.Until(deadline), stop)
+		headersLate = func() bool { return !timer.Stop() }
+	}
+	req, err := http.NewRequestWithContext(ctx, cfg.method, url, nil)
 	if err != nil {
-		resps.SetResponse(url, Response{Error: err})
-		return
+		return Response{Error: err}, nil
 	}
-	resp, err := http.DefaultClient.Do(req)
+	release, err := h.acquireHost(ctx, req.URL.Host)
 	if err != nil {
-		resps.SetResponse(url, Response{Error: err})
-		return
+		return Response{Error: err}, nil
+	}
+	defer release()
+	if h.userAgent != "" {
+		req.Header.Set("User-Agent", h.userAgent)
+	}
+	for name, values := range cfg.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	if encoding := h.acceptEncoding(); encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	}
+	if cfg.host != "" {
+		// Only the first request is sent to the virtual host, redirects follow their locations.
+		req.Host = cfg.host
+	}
+	req.Close = h.noKeepAlive[strings.ToLower(req.URL.Host)] || h.noKeepAlive[strings.ToLower(req.URL.Hostname())]
+	var remoteIP string
+	var conn *countingConn
+	var connReceived int64
+	if h.collectTrace || h.countWire {
+		req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if h.collectTrace {
+					remoteIP, _, _ = net.SplitHostPort(info.Conn.RemoteAddr().String())
+				}
+				if c := countingConnOf(info.Conn); c != nil {
+					conn, connReceived = c, c.received()
+				}
+			},
+		}))
+	}
+	client := h.client
+	start := time.Now()
+	var sentHeader http.Header
+	hostPolicy := h.allowedHosts != nil || h.deniedHosts != nil
+	if h.reportHops || h.maxRedirects >= 0 || hostPolicy || h.echoHeaders || cfg.jar != nil {
+		c := *h.client
+		if h.reportHops {
+			c.CheckRedirect = h.recordHops(&hops, start)
+		} else if h.maxRedirects >= 0 || hostPolicy {
+			c.CheckRedirect = h.checkRedirect
+		}
+		if h.echoHeaders {
+			c.Transport = &headerRecorder{base: transportOf(h.client), header: &sentHeader}
+		}
+		if cfg.jar != nil {
+			c.Jar = cfg.jar
+		}
+		client = &c
+	}
+	resp, err := client.Do(req)
+	duration := time.Since(start)
+	if headersLate() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = fmt.Errorf("%w: no response headers before the timeout", context.DeadlineExceeded)
+	}
+	sentHeader = h.redactHeaders(sentHeader)
+	if err != nil {
+		r = Response{Error: classifyError(err), Duration: duration, RemoteIP: remoteIP, RequestHeader: sentHeader}
+		if conn != nil && errors.Is(r.Error, ErrUnsupportedTransferEncoding) {
+			r.WireSize = conn.received() - connReceived
+		}
+		return r, hops
+	}
+	r = Response{Response: resp, StatusCode: resp.StatusCode, Duration: duration, RemoteIP: remoteIP, RequestHeader: sentHeader}
+	r.FinalURL = resp.Request.URL.String()
+	h.detectAttachment(&r)
+	r.SLAViolated = h.slaThreshold > 0 && duration > h.slaThreshold
+	var sink io.WriteCloser
+	if h.sinkFactory != nil && cfg.method != http.MethodHead {
+		if sink = h.sinkFactory(url); sink != nil {
+			defer sink.Close()
+		}
+	}
+	r.Error = h.readResponse(ctx, &r, sink)
+	if r.Error == nil && time.Now().After(deadline) {
+		// The response has only completed within the drain grace period.
+		r.Error = fmt.Errorf("%w: response completed after the timeout", context.DeadlineExceeded)
+	}
+	h.truncateHeaders(&r)
+	return r, hops
+}
+
+// acquireHost waits for a free slot for the host if the global per-host limit is set.
+// The returned function releases the slot.
+func (h *HTTPHandler) acquireHost(ctx context.Context, host string) (release func(), err error) {
+	if h.hostLimit <= 0 {
+		return func() {}, nil
+	}
+	h.hostLocksMu.Lock()
+	if h.hostLocks == nil {
+		h.hostLocks = make(map[string]*hostLock)
+	}
+	lock, ok := h.hostLocks[host]
+	if !ok {
+		lock = &hostLock{slots: make(chan struct{}, h.hostLimit)}
+		h.hostLocks[host] = lock
+	}
+	lock.refs++
+	h.hostLocksMu.Unlock()
+
+	unref := func() {
+		h.hostLocksMu.Lock()
+		defer h.hostLocksMu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(h.hostLocks, host)
+		}
+	}
+	select {
+	case lock.slots <- struct{}{}:
+		return func() {
+			<-lock.slots
+			unref()
+		}, nil
+	case <-ctx.Done():
+		unref()
+		return nil, ctx.Err()
+	}
+}
+
+// classifiedError is a transport error along with the distinct error of its cause.
+// Both of them are matched by errors.Is, and the transport error by errors.As.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.class.Error() + ": " + e.err.Error()
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classifyError wraps the transport error with a distinct error if its cause is recognized.
+func classifyError(err error) error {
+	// The transport reports a connection closed before the response as EOF
+	// or, depending on the connection state, with an unexported error.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "server closed idle connection") {
+		return &classifiedError{class: ErrEmptyResponse, err: err}
+	}
+	if isTLSError(err) {
+		return &classifiedError{class: ErrTLSFailure, err: err}
+	}
+	if strings.Contains(err.Error(), "unsupported transfer encoding") ||
+		strings.Contains(err.Error(), "too many transfer encodings") {
+		return &classifiedError{class: ErrUnsupportedTransferEncoding, err: err}
+	}
+	return err
+}
+
+// isTLSError reports whether the error is a failure of the TLS handshake or of the certificate verification.
+func isTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		opErr        *net.OpError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) {
+		return true
+	}
+	// The alerts sent or received during the handshake are wrapped with these operations.
+	if errors.As(err, &opErr) && (opErr.Op == "local error" || opErr.Op == "remote error") {
+		return true
 	}
-	resps.SetResponse(url, Response{Response: resp})
+	// The transport replaces the record header error of a server not speaking TLS at all with its own error.
+	return strings.Contains(err.Error(), "server gave HTTP response to HTTPS client")
 }
@@ -3,14 +3,27 @@ package httphandler
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type TestParams struct {
@@ -168,3 +181,1619 @@ func testRequestOverload(handler http.Handler, i int, overloaded chan struct{},
 		}
 	}
 }
+
+func TestHTTPHandlerStreamingFetch(t *testing.T) {
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "/", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		NewHTTPHandler().ServeHTTP(rr, req)
+		close(done)
+	}()
+
+	fmt.Fprintln(pw, srv.URL+"/first")
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("streaming test: fetch did not start before the body was fully read")
+	}
+	fmt.Fprintln(pw, srv.URL+"/second")
+	pw.Close()
+	<-done
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("streaming test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestHTTPHandlerStreamingInvalidURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	body := srv.URL + "\ninvalidurl\n"
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	NewHTTPHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("abort test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	handler := NewHTTPHandler()
+	handler.SetSkipInvalid(true)
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("skip test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if strings.TrimSpace(rr.Body.String()) != "2" {
+		t.Errorf("skip test: handler returned unexpected body: %q", rr.Body.String())
+	}
+}
+
+func TestHTTPHandlerPartialStatusCode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	for _, code := range []int{99, 100, http.StatusNoContent, http.StatusNotModified, 600} {
+		if err := handler.SetPartialStatusCode(code); err == nil {
+			t.Errorf("partial status test: code %d unexpectedly accepted", code)
+		}
+	}
+	if err := handler.SetPartialStatusCode(http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+
+	body := srv.URL + "\nhttp://127.0.0.1:1\n"
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("partial status test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	param := TestParams{RespSizes: []int{-1, 2}}
+	if sizes, valid := param.IsResponseBodyValid(rr.Body); !valid {
+		t.Errorf("partial status test: handler returned unexpected body: got %v want %v", sizes, param.RespSizes)
+	}
+}
+
+func TestHTTPHandlerAtomic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetAtomic(true)
+	tests := []struct {
+		body     string
+		respCode int
+		respBody string
+	}{
+		{body: srv.URL + "\nhttp://127.0.0.1:1\n", respCode: http.StatusFailedDependency},
+		{body: srv.URL, respCode: http.StatusOK, respBody: "2\n"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("atomic test: handler returned wrong status code: got %v want %v", rr.Code, tt.respCode)
+		}
+		if rr.Body.String() != tt.respBody {
+			t.Errorf("atomic test: handler returned unexpected body: got %q want %q", rr.Body.String(), tt.respBody)
+		}
+	}
+}
+
+func TestHTTPHandlerEndpointAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetEndpointAuth("user", "secret")
+
+	tests := []struct {
+		name     string
+		setAuth  bool
+		username string
+		password string
+		respCode int
+	}{
+		{name: "missing", respCode: http.StatusUnauthorized},
+		{name: "wrong", setAuth: true, username: "user", password: "wrong", respCode: http.StatusUnauthorized},
+		{name: "correct", setAuth: true, username: "user", password: "secret", respCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		if tt.setAuth {
+			req.SetBasicAuth(tt.username, tt.password)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("auth test %s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.respCode)
+		}
+		if tt.respCode == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("auth test %s: WWW-Authenticate header is missing", tt.name)
+		}
+	}
+}
+
+// concurrencyServer is a stub server that tracks the maximum number of simultaneously served requests
+// and the order the requests were received in.
+type concurrencyServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	current int
+	max     int
+	paths   []string
+}
+
+func newConcurrencyServer(delay time.Duration) *concurrencyServer {
+	cs := &concurrencyServer{}
+	cs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cs.mu.Lock()
+		cs.paths = append(cs.paths, r.URL.Path)
+		cs.current++
+		if cs.current > cs.max {
+			cs.max = cs.current
+		}
+		cs.mu.Unlock()
+		time.Sleep(delay)
+		cs.mu.Lock()
+		cs.current--
+		cs.mu.Unlock()
+		fmt.Fprint(w, "ok")
+	}))
+	return cs
+}
+
+func (cs *concurrencyServer) Max() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.max
+}
+
+func (cs *concurrencyServer) Paths() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return append([]string(nil), cs.paths...)
+}
+
+func TestHTTPHandlerGlobalPerHostLimit(t *testing.T) {
+	const limit = 2
+	srv := newConcurrencyServer(50 * time.Millisecond)
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	handler.SetGlobalPerHostLimit(limit)
+
+	wg := new(sync.WaitGroup)
+	for batch := 0; batch < 2; batch++ {
+		wg.Add(1)
+		go func(batch int) {
+			defer wg.Done()
+			buf := bytes.NewBuffer(nil)
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(buf, "%s/%d/%d\n", srv.URL, batch, i)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", buf)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("per-host limit test: batch %d returned wrong status code: got %v want %v", batch, rr.Code, http.StatusOK)
+			}
+		}(batch)
+	}
+	wg.Wait()
+
+	if max := srv.Max(); max > limit {
+		t.Errorf("per-host limit test: %d simultaneous requests, limit is %d", max, limit)
+	}
+	if len(handler.hostLocks) != 0 {
+		t.Errorf("per-host limit test: %d host locks were not released", len(handler.hostLocks))
+	}
+}
+
+func TestHTTPHandlerPerHostLimitOtherHosts(t *testing.T) {
+	const delay = 150 * time.Millisecond
+	a, b := newConcurrencyServer(delay), newConcurrencyServer(delay)
+	defer a.Close()
+	defer b.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	handler.SetGlobalPerHostLimit(1)
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(buf, "%s/%d\n%s/%d\n", a.URL, i, b.URL, i)
+	}
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", buf))
+	elapsed := time.Since(start)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("per-host limit test: got status %d want %d", rr.Code, http.StatusOK)
+	}
+	if a.Max() > 1 || b.Max() > 1 {
+		t.Errorf("per-host limit test: %d and %d simultaneous requests, limit is 1", a.Max(), b.Max())
+	}
+	// The hosts are fetched in parallel, so the batch takes about 3 delays rather than 6.
+	if elapsed >= 5*delay {
+		t.Errorf("per-host limit test: requests to different hosts were serialized, batch took %v", elapsed)
+	}
+}
+
+func TestHTTPHandlerCompressionAudit(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible "), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write(content)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(content)
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetCompressionAudit(true)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := resps.Map[srv.URL]
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp.Size != int64(len(content)) {
+		t.Errorf("compression audit test: wrong decompressed size: got %d want %d", resp.Size, len(content))
+	}
+	if resp.WireSize <= 0 || resp.WireSize >= resp.Size {
+		t.Errorf("compression audit test: wire size %d is not smaller than decompressed size %d", resp.WireSize, resp.Size)
+	}
+}
+
+func TestHTTPHandlerDecompressionBomb(t *testing.T) {
+	// 16 MiB of zeros compress to a few KiB.
+	var bomb bytes.Buffer
+	gz := gzip.NewWriter(&bomb)
+	gz.Write(make([]byte, 16<<20))
+	gz.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(bomb.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		ratio     float64
+		maxSize   int64
+		bomb      bool
+		size      int64
+		truncated bool
+		// noAudit leaves the body to the transport unless the ratio is set.
+		noAudit bool
+	}{
+		{size: 16 << 20},
+		{ratio: 100, bomb: true},
+		{ratio: 10000, size: 16 << 20},
+		// The decompressed size is capped before the ratio is exceeded.
+		{ratio: 100, maxSize: 1 << 10, size: 1 << 10, truncated: true},
+		{ratio: 100, bomb: true, noAudit: true},
+		{size: 16 << 20, noAudit: true},
+	} {
+		handler := NewHTTPHandler()
+		handler.SetCompressionAudit(!tt.noAudit)
+		handler.SetMaxBodySize(tt.maxSize)
+		if err := handler.SetMaxDecompressionRatio(tt.ratio); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL]
+		if errors.Is(resp.Error, ErrDecompressionBomb) != tt.bomb || (!tt.bomb && resp.Error != nil) {
+			t.Errorf("decompression bomb test %+v: got error %v", tt, resp.Error)
+		}
+		if !tt.bomb && (resp.Size != tt.size || resp.BodyTruncated != tt.truncated) {
+			t.Errorf("decompression bomb test %+v: got size %d truncated %v", tt, resp.Size, resp.BodyTruncated)
+		}
+	}
+}
+
+func TestHTTPHandlerDecompress(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible "), 1000)
+	encoded := make(map[string][]byte)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(content)
+	gz.Close()
+	encoded["/gzip"] = append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	zw := zlib.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	encoded["/deflate"] = append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(content)
+	fw.Close()
+	encoded["/raw-deflate"] = append([]byte(nil), buf.Bytes()...)
+	encoded["/broken"] = []byte("not gzip at all")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" || r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			w.Header().Set("Content-Encoding", "deflate")
+		}
+		w.Write(encoded[r.URL.Path])
+	}))
+	defer srv.Close()
+	body := srv.URL + "/gzip\n" + srv.URL + "/deflate\n" + srv.URL + "/raw-deflate\n" + srv.URL + "/broken"
+
+	handler := NewHTTPHandler()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/deflate", "/raw-deflate"} {
+		if resp := resps.Map[srv.URL+path]; resp.Error != nil || resp.Size != int64(len(encoded[path])) {
+			t.Errorf("decompress test: %s without decoding: got size %d and error %v want raw size %d", path, resp.Size, resp.Error, len(encoded[path]))
+		}
+	}
+
+	handler.SetDecompress(true)
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err = handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/gzip", "/deflate", "/raw-deflate"} {
+		if resp := resps.Map[srv.URL+path]; resp.Error != nil || resp.Size != int64(len(content)) {
+			t.Errorf("decompress test: %s: got size %d and error %v want decoded size %d", path, resp.Size, resp.Error, len(content))
+		}
+	}
+	if resp := resps.Map[srv.URL+"/broken"]; !errors.Is(resp.Error, ErrContentDecoding) {
+		t.Errorf("decompress test: broken body got error %v want %v", resp.Error, ErrContentDecoding)
+	}
+}
+
+func TestHTTPHandlerEmptyResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	urlString := "http://" + ln.Addr().String()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+	resps, err := NewHTTPHandler().executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resps.Map[urlString].Error; !errors.Is(err, ErrEmptyResponse) {
+		t.Errorf("empty response test: got error %v want %v", err, ErrEmptyResponse)
+	}
+}
+
+func TestHTTPHandlerSLAThreshold(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(time.Second)
+	handler.SetSLAThreshold(50 * time.Millisecond)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/fast\n"+srv.URL+"/slow\n"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resps.AllSuccessful() {
+		t.Error("SLA test: SLA violation was recorded as a failure")
+	}
+	if resps.Map[srv.URL+"/fast"].SLAViolated || !resps.Map[srv.URL+"/slow"].SLAViolated {
+		t.Error("SLA test: SLA violation flags are wrong")
+	}
+	if summary := resps.Summary(); summary.SLAViolations != 1 {
+		t.Errorf("SLA test: got %d SLA violations want 1", summary.SLAViolations)
+	}
+}
+
+func TestHTTPHandlerDefaultScheme(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	// The scheme in the query does not count as the scheme of the URL.
+	hostPath := strings.TrimPrefix(srv.URL, "http://") + "/path?next=http://example.com"
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(hostPath))
+	if _, err := NewHTTPHandler().executeAllRequests(req); err == nil {
+		t.Error("default scheme test: URL without scheme unexpectedly accepted")
+	}
+
+	handler := NewHTTPHandler()
+	handler.SetDefaultScheme("http")
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(hostPath))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := resps.Map["http://"+hostPath]
+	if !ok {
+		t.Fatalf("default scheme test: prefixed URL is not reported, got %v", resps.Map)
+	}
+	if resp.Error != nil {
+		t.Error(resp.Error)
+	}
+}
+
+func TestHTTPHandlerTraceRemoteIP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	wantIP, _, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewHTTPHandler()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := resps.Map[srv.URL].RemoteIP; ip != "" {
+		t.Errorf("trace test: IP %s recorded with trace collection disabled", ip)
+	}
+
+	handler.SetTraceCollection(true)
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	resps, err = handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := resps.Map[srv.URL].RemoteIP; ip != wantIP {
+		t.Errorf("trace test: got IP %q want %q", ip, wantIP)
+	}
+}
+
+func TestHTTPHandlerClientDisconnect(t *testing.T) {
+	received := make(chan struct{}, 2)
+	cancelled := make(chan struct{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(10 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\n"+srv.URL+"/b\n")).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(rr, req)
+		close(done)
+	}()
+
+	<-received
+	<-received
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect test: handler did not return after the client has gone")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("disconnect test: upstream request was not cancelled")
+		}
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("disconnect test: response was written: %q", rr.Body.String())
+	}
+	if len(handler.requestLocks) != 0 {
+		t.Error("disconnect test: request slot was not released")
+	}
+}
+
+func TestHTTPHandlerSchemeTimeout(t *testing.T) {
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(time.Second)
+	handler.SetSchemeTimeout("HTTPS", 3*time.Second)
+
+	tests := map[string]time.Duration{
+		"http://example.com":  time.Second,
+		"https://example.com": 3 * time.Second,
+		"HTTPS://example.com": 3 * time.Second,
+	}
+	for urlString, want := range tests {
+		if got := handler.timeoutFor(urlString); got != want {
+			t.Errorf("scheme timeout test: %s: got %v want %v", urlString, got, want)
+		}
+	}
+
+	handler.SetSchemeTimeout("https", 0)
+	if got := handler.timeoutFor("https://example.com"); got != time.Second {
+		t.Errorf("scheme timeout test: removed override: got %v want %v", got, time.Second)
+	}
+}
+
+func TestHTTPHandlerPauseResume(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRetryAfter(1500 * time.Millisecond)
+	var retryAfter string
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		retryAfter = rr.Header().Get("Retry-After")
+		return rr.Code
+	}
+
+	handler.Pause()
+	handler.Pause()
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("pause test: paused handler returned %v want %v", code, http.StatusServiceUnavailable)
+	}
+	if retryAfter != "2" {
+		t.Errorf("pause test: got Retry-After %q want %q", retryAfter, "2")
+	}
+	if len(handler.requestLocks) != 0 {
+		t.Error("pause test: paused handler acquired a request slot")
+	}
+	handler.Resume()
+	handler.Resume()
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("pause test: resumed handler returned %v want %v", code, http.StatusOK)
+	}
+}
+
+func TestHTTPHandlerMaxCapturedHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 200; i++ {
+			w.Header().Set(fmt.Sprintf("X-Header-%03d", i), "value")
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		count, size int
+		want        int
+	}{
+		{count: 10, want: 10},
+		{size: 20, want: 1},
+		{count: 10, size: 20, want: 1},
+	}
+	for _, tt := range tests {
+		handler := NewHTTPHandler()
+		handler.SetMaxCapturedHeaders(tt.count, tt.size)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL]
+		if len(resp.Header) != tt.want || !resp.HeadersTruncated {
+			t.Errorf("headers limit test: count %d, size %d: got %d headers, truncated %v want %d headers, truncated",
+				tt.count, tt.size, len(resp.Header), resp.HeadersTruncated, tt.want)
+		}
+	}
+}
+
+func TestHTTPHandlerReportRedirectHops(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusMovedPermanently)
+		default:
+			fmt.Fprint(w, "final")
+		}
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetReportRedirectHops(true)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resps.Len() != 3 {
+		t.Fatalf("redirect hops test: got %d entries want 3: %v", resps.Len(), resps.Map)
+	}
+	wantStatus := map[string]int{
+		srv.URL + "/a": http.StatusFound,
+		srv.URL + "/b": http.StatusMovedPermanently,
+		srv.URL + "/c": http.StatusOK,
+	}
+	for url, status := range wantStatus {
+		resp, ok := resps.Map[url]
+		if !ok || resp.Error != nil || resp.Response == nil || resp.StatusCode != status {
+			t.Errorf("redirect hops test: %s: got %+v want status %d", url, resp, status)
+		}
+	}
+	if loc := resps.Map[srv.URL+"/a"].Header.Get("Location"); loc != "/b" {
+		t.Errorf("redirect hops test: got location %q want %q", loc, "/b")
+	}
+	if size := resps.Map[srv.URL+"/c"].Size; size != int64(len("final")) {
+		t.Errorf("redirect hops test: got final size %d want %d", size, len("final"))
+	}
+}
+
+func TestHTTPHandlerMaxRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusMovedPermanently)
+		default:
+			fmt.Fprint(w, "final")
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		max      int
+		status   int
+		finalURL string
+	}{
+		{max: -1, status: http.StatusOK, finalURL: srv.URL + "/c"},
+		{max: 0, status: http.StatusFound, finalURL: srv.URL + "/a"},
+		{max: 1, status: http.StatusMovedPermanently, finalURL: srv.URL + "/b"},
+		{max: 2, status: http.StatusOK, finalURL: srv.URL + "/c"},
+	} {
+		handler := NewHTTPHandler()
+		handler.SetMaxRedirects(tt.max)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a"))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL+"/a"]
+		if resp.Error != nil || resp.StatusCode != tt.status || resp.FinalURL != tt.finalURL {
+			t.Errorf("max redirects test %d: got status %d final URL %q error %v, want status %d final URL %q",
+				tt.max, resp.StatusCode, resp.FinalURL, resp.Error, tt.status, tt.finalURL)
+		}
+	}
+}
+
+func TestHTTPHandlerHTTP10Client(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\n"+srv.URL+"/b\n"))
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+	rr := httptest.NewRecorder()
+	NewHTTPHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("HTTP/1.0 test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != strconv.Itoa(rr.Body.Len()) {
+		t.Errorf("HTTP/1.0 test: got Content-Length %q for %d bytes of body", cl, rr.Body.Len())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	rr = httptest.NewRecorder()
+	NewHTTPHandler().ServeHTTP(rr, req)
+	if cl := rr.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("HTTP/1.0 test: HTTP/1.1 response is buffered with Content-Length %q", cl)
+	}
+}
+
+// failingWriter is a response writer failing to write the body.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (fw failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestHTTPHandlerPanicRecovery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := NewHTTPHandlerWithRequestLimit(1)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(failingWriter{rr}, req)
+		if rr.Code == http.StatusTooManyRequests {
+			t.Fatalf("panic test: request #%d was rejected, capacity was not recovered", i+1)
+		}
+	}
+	if len(handler.requestLocks) != 0 {
+		t.Error("panic test: request slot was not released")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("panic test: handler returned wrong status code after recovery: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+// headerCounter is a response writer counting the WriteHeader calls and failing to write the body.
+type headerCounter struct {
+	failingWriter
+	headers int
+}
+
+func (hc *headerCounter) WriteHeader(code int) {
+	hc.headers++
+	hc.failingWriter.WriteHeader(code)
+}
+
+func TestHTTPHandlerPanicAfterHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	rr := httptest.NewRecorder()
+	hc := &headerCounter{failingWriter: failingWriter{rr}}
+	NewHTTPHandler().ServeHTTP(hc, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL)))
+	if hc.headers != 1 || rr.Code != http.StatusOK {
+		t.Errorf("panic after header test: got %d headers with status %v want 1 with status %v", hc.headers, rr.Code, http.StatusOK)
+	}
+}
+
+func TestHTTPHandlerHookPanic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := NewHTTPHandler()
+	handler.SetResponseValidator(func(url string, r Response) error {
+		if strings.HasSuffix(url, "/validator") {
+			panic("validator failed")
+		}
+		return nil
+	})
+	handler.SetLogger(func(url string, err error, duration time.Duration) {
+		if strings.HasSuffix(url, "/logger") {
+			panic("logger failed")
+		}
+	})
+	body := srv.URL + "/ok\n" + srv.URL + "/validator\n" + srv.URL + "/logger"
+	resps, err := handler.executeAllRequests(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[srv.URL+"/validator"]; !errors.Is(resp.Error, ErrRequestPanic) {
+		t.Errorf("hook panic test: got error %v want %v", resp.Error, ErrRequestPanic)
+	}
+	// The response is recorded before the logger is called.
+	for _, path := range []string{"/ok", "/logger"} {
+		if resp := resps.Map[srv.URL+path]; resp.Error != nil || resp.Size != 2 {
+			t.Errorf("hook panic test: %s got size %d and error %v want size 2", path, resp.Size, resp.Error)
+		}
+	}
+}
+
+func TestHTTPHandlerAdvertiseLimits(t *testing.T) {
+	handler := NewHTTPHandlerWithRequestLimit(20)
+	handler.SetRequestTimeout(5 * time.Second)
+	handler.SetGlobalPerHostLimit(4)
+	handler.SetAdvertiseLimits(true)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	want := "concurrency=20, request-timeout=5s, per-host=4"
+	if got := rr.Header().Get("X-Handler-Limits"); got != want {
+		t.Errorf("limits test: got %q want %q", got, want)
+	}
+
+	handler.SetAdvertiseLimits(false)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("X-Handler-Limits"); got != "" {
+		t.Errorf("limits test: limits advertised when disabled: %q", got)
+	}
+}
+
+func TestHTTPHandlerRequiredURLPrefix(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	offender := "http://127.0.0.1:1/outside"
+	body := srv.URL + "/api/a\n" + offender + "\n" + srv.URL + "/api/b\n"
+
+	handler := NewHTTPHandler()
+	handler.SetRequiredURLPrefix(srv.URL + "/api/")
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	_, err := handler.executeAllRequests(req)
+	if !errors.Is(err, ErrURLPrefixMismatch) || !strings.Contains(err.Error(), offender) {
+		t.Errorf("prefix test: got error %v want %v naming %s", err, ErrURLPrefixMismatch, offender)
+	}
+
+	handler.SetSkipInvalid(true)
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resps.Map[offender]; ok || resps.Len() != 2 {
+		t.Errorf("prefix test: off-prefix URL was not skipped: %v", resps.Map)
+	}
+}
+
+func TestHTTPHandlerRequiredURLPrefixBypass(t *testing.T) {
+	handler := NewHTTPHandler()
+	if err := handler.SetRequiredURLPrefix("https://example.com/api"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		url string
+		ok  bool
+	}{
+		{url: "https://example.com/api", ok: true},
+		{url: "https://EXAMPLE.com/api/v1", ok: true},
+		{url: "https://example.com.evil.net/api/v1"},
+		{url: "https://example.com@evil.net/api/v1"},
+		{url: "https://example.com:8443/api/v1"},
+		{url: "https://example.com/apiary"},
+		{url: "https://example.com/api/../admin"},
+		{url: "http://example.com/api/v1"},
+	} {
+		if err := handler.validateURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("prefix bypass test: %s: got error %v want ok %v", tt.url, err, tt.ok)
+		}
+	}
+
+	if err := handler.SetRequiredURLPrefix("example.com/api"); err == nil {
+		t.Error("prefix bypass test: prefix without scheme accepted")
+	}
+}
+
+func TestHTTPHandlerAllowedSchemes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	for _, offender := range []string{"file:///etc/passwd", "ftp://127.0.0.1/file"} {
+		handler := NewHTTPHandler()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"\n"+offender))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("schemes test: %s got status %d want %d", offender, rec.Code, http.StatusBadRequest)
+		}
+		req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(offender))
+		if _, err := handler.executeAllRequests(req); !errors.Is(err, ErrSchemeNotAllowed) {
+			t.Errorf("schemes test: %s got error %v want %v", offender, err, ErrSchemeNotAllowed)
+		}
+	}
+
+	handler := NewHTTPHandler()
+	handler.SetAllowedSchemes([]string{"HTTPS"})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	if _, err := handler.executeAllRequests(req); !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Errorf("schemes test: http with only https allowed got error %v want %v", err, ErrSchemeNotAllowed)
+	}
+}
+
+func TestHTTPHandlerDownloadContentTypeFilter(t *testing.T) {
+	var mu sync.Mutex
+	gets := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			gets[r.URL.Path]++
+			mu.Unlock()
+		}
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			fmt.Fprint(w, `{"a":1}`)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html></html>")
+		}
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetDownloadContentTypeFilter([]string{"application/json"})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/json\n"+srv.URL+"/html\n"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gets["/json"] != 1 || gets["/html"] != 0 {
+		t.Errorf("download filter test: unexpected GET requests %v", gets)
+	}
+	if resp := resps.Map[srv.URL+"/json"]; resp.BodySkipped || resp.Size != 7 {
+		t.Errorf("download filter test: matching body: got size %d, skipped %v", resp.Size, resp.BodySkipped)
+	}
+	if resp := resps.Map[srv.URL+"/html"]; !resp.BodySkipped || resp.Size != 13 {
+		t.Errorf("download filter test: filtered body: got size %d, skipped %v", resp.Size, resp.BodySkipped)
+	}
+}
+
+func TestHTTPHandlerSequential(t *testing.T) {
+	srv := newConcurrencyServer(10 * time.Millisecond)
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetSequential(true)
+	var body strings.Builder
+	var want []string
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&body, "%s/%d\n", srv.URL, i)
+		want = append(want, fmt.Sprintf("/%d", i))
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body.String()))
+	if _, err := handler.executeAllRequests(req); err != nil {
+		t.Fatal(err)
+	}
+	if max := srv.Max(); max != 1 {
+		t.Errorf("sequential test: got %d simultaneous requests want 1", max)
+	}
+	if paths := srv.Paths(); !reflect.DeepEqual(paths, want) {
+		t.Errorf("sequential test: got order %v want %v", paths, want)
+	}
+}
+
+func TestHTTPHandlerInputSummary(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/json") {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, "{}")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html></html>")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetSkipInvalid(true)
+	handler.SetRequiredURLPrefix(srv.URL + "/allowed/")
+	handler.SetDownloadContentTypeFilter([]string{"application/json"})
+	body := strings.Join([]string{
+		srv.URL + "/allowed/json",
+		srv.URL + "/allowed/html",
+		srv.URL + "/allowed/json",
+		"not a url",
+		srv.URL + "/denied/json",
+	}, "\n")
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := resps.Summary()
+	want := Summary{
+		Total:            2,
+		Lines:            5,
+		Fetched:          2,
+		SkippedInvalid:   1,
+		SkippedDuplicate: 1,
+		Denied:           1,
+		Filtered:         1,
+	}
+	if summary != want {
+		t.Errorf("input summary test: got %+v want %+v", summary, want)
+	}
+	if summary.Fetched+summary.SkippedInvalid+summary.SkippedDuplicate+summary.Denied != summary.Lines {
+		t.Errorf("input summary test: counts do not add up to %d lines: %+v", summary.Lines, summary)
+	}
+
+	// The URLs rejected by the host lists are denied too, but still reported with their errors.
+	handler = NewHTTPHandler()
+	handler.SetAllowedHosts([]string{"example.com"})
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/allowed/json"))
+	if resps, err = handler.executeAllRequests(req); err != nil {
+		t.Fatal(err)
+	}
+	want = Summary{Total: 1, Failed: 1, Lines: 1, Denied: 1}
+	if summary := resps.Summary(); summary != want {
+		t.Errorf("input summary test: got %+v want %+v", summary, want)
+	}
+}
+
+func TestHTTPHandlerURLRewriter(t *testing.T) {
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		fmt.Fprint(w, "rewritten")
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewHTTPHandler()
+	handler.SetURLRewriter(func(u *url.URL) *url.URL {
+		switch u.Hostname() {
+		case "service.local":
+			u.Host = target.Host
+			return u
+		case "rejected.local":
+			return nil
+		}
+		return u
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("http://service.local/path\nhttp://rejected.local/"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := resps.Map["http://service.local/path"]; !ok || resp.Error != nil || resp.Size != 9 {
+		t.Errorf("rewriter test: no response under the original URL, got %+v, %v", resp, ok)
+	}
+	if host != target.Host {
+		t.Errorf("rewriter test: got request to %s want %s", host, target.Host)
+	}
+	if resp := resps.Map["http://rejected.local/"]; !errors.Is(resp.Error, ErrURLRejected) {
+		t.Errorf("rewriter test: got error %v want %v", resp.Error, ErrURLRejected)
+	}
+	if resps.Len() != 2 {
+		t.Errorf("rewriter test: got %d responses want 2", resps.Len())
+	}
+}
+
+func TestHTTPHandlerResponseValidator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", len(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	errTooSmall := errors.New("response too small")
+	handler := NewHTTPHandler()
+	handler.SetResponseValidator(func(url string, r Response) error {
+		if r.Size < 5 {
+			return errTooSmall
+		}
+		return nil
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/ab\n"+srv.URL+"/abcdef"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[srv.URL+"/ab"]; !errors.Is(resp.Error, errTooSmall) {
+		t.Errorf("validator test: small response did not fail, got error %v", resp.Error)
+	}
+	if resp := resps.Map[srv.URL+"/abcdef"]; resp.Error != nil {
+		t.Errorf("validator test: unexpected error %v", resp.Error)
+	}
+	if summary := resps.Summary(); summary.Failed != 1 {
+		t.Errorf("validator test: got %d failed responses want 1", summary.Failed)
+	}
+}
+
+func TestHTTPHandlerAcceptableSizeRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", len(r.URL.Path)))
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	if err := handler.SetAcceptableSizeRange(3, 5); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\n"+srv.URL+"/ab\n"+srv.URL+"/abcd\n"+srv.URL+"/abcde"))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, inRange := range map[string]bool{"/a": false, "/ab": true, "/abcd": true, "/abcde": false} {
+		resp := resps.Map[srv.URL+path]
+		if inRange && resp.Error != nil {
+			t.Errorf("size range test: unexpected error %v for %s", resp.Error, path)
+		}
+		if !inRange && !errors.Is(resp.Error, ErrSizeOutOfRange) {
+			t.Errorf("size range test: %s got error %v want %v", path, resp.Error, ErrSizeOutOfRange)
+		}
+	}
+	if summary := resps.Summary(); summary.Failed != 2 {
+		t.Errorf("size range test: got %d failed responses want 2", summary.Failed)
+	}
+
+	if err := handler.SetAcceptableSizeRange(5, 3); err == nil {
+		t.Error("size range test: inverted range unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerRequireContentType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/typed":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, "{}")
+		case "/error":
+			// The error responses are not checked.
+			w.Header()["Content-Type"] = nil
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			// Suppress the content type sniffed by the server.
+			w.Header()["Content-Type"] = nil
+			fmt.Fprint(w, "untyped")
+		}
+	}))
+	defer srv.Close()
+	body := srv.URL + "/typed\n" + srv.URL + "/untyped\n" + srv.URL + "/error"
+
+	for _, required := range []bool{false, true} {
+		handler := NewHTTPHandler()
+		handler.SetRequireContentType(required)
+		resps, err := handler.executeAllRequests(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := resps.Map[srv.URL+"/typed"]; resp.Error != nil {
+			t.Errorf("content type test with required %v: unexpected error %v", required, resp.Error)
+		}
+		if resp := resps.Map[srv.URL+"/error"]; resp.Error != nil {
+			t.Errorf("content type test with required %v: unexpected error %v for error response", required, resp.Error)
+		}
+		resp := resps.Map[srv.URL+"/untyped"]
+		if required && !errors.Is(resp.Error, ErrMissingContentType) {
+			t.Errorf("content type test: got error %v want %v", resp.Error, ErrMissingContentType)
+		}
+		if !required && resp.Error != nil {
+			t.Errorf("content type test: untyped response failed with %v when not required", resp.Error)
+		}
+	}
+}
+
+func TestHTTPHandlerExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+	handler := NewHTTPHandler()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// send writes the request headers and returns the status line of the first response.
+	send := func(conn net.Conn, reader *bufio.Reader) string {
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n",
+			srv.Listener.Addr(), len(upstream.URL))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if line := send(conn, reader); line != "HTTP/1.1 100 Continue" {
+		t.Fatalf("expect continue test: got %q want the interim response", line)
+	}
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, upstream.URL)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expect continue test: handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// A paused handler rejects the request without asking for the body.
+	handler.Pause()
+	conn, err = net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader = bufio.NewReader(conn)
+	if line := send(conn, reader); line != "HTTP/1.1 503 Service Unavailable" {
+		t.Errorf("expect continue test: got %q want the final rejection", line)
+	}
+}
+
+func TestResponseMapSetResponseTwice(t *testing.T) {
+	const urlString = "http://example.com/"
+	resps := NewResponseMap()
+	if err := resps.Create(urlString); err != nil {
+		t.Fatal(err)
+	}
+	// A response without an *http.Response nor an error still counts as assigned.
+	if err := resps.SetResponse(urlString, Response{BodySkipped: true}); err != nil {
+		t.Fatalf("set response test: first write failed: %v", err)
+	}
+	if err := resps.SetResponse(urlString, Response{Size: 1}); err == nil {
+		t.Error("set response test: second write unexpectedly succeeded")
+	}
+	if got := resps.Map[urlString]; !got.BodySkipped || got.Size != 0 {
+		t.Errorf("set response test: first response was overwritten: %+v", got)
+	}
+}
+
+func TestResponseMapLiteral(t *testing.T) {
+	const urlString = "http://example.com/"
+	resps := &ResponseMap{Map: make(map[string]Response)}
+	if err := resps.SetResponse(urlString, Response{Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resps.SetResponse(urlString, Response{Size: 2}); err == nil {
+		t.Error("response map literal test: second write unexpectedly succeeded")
+	}
+	if got := resps.Map[urlString].Size; got != 1 {
+		t.Errorf("response map literal test: got size %v want %v", got, 1)
+	}
+}
+
+func TestResponseMapSetResponseStatusCode(t *testing.T) {
+	const urlString = "http://example.com/"
+	resps := NewResponseMap()
+	// Library callers only set the embedded response.
+	if err := resps.SetResponse(urlString, Response{Response: &http.Response{StatusCode: http.StatusBadGateway}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := resps.Map[urlString].StatusCode; got != http.StatusBadGateway {
+		t.Errorf("status code test: got %v want %v", got, http.StatusBadGateway)
+	}
+	if resps.serverErrors != 1 {
+		t.Errorf("status code test: got %v server errors want 1", resps.serverErrors)
+	}
+}
+
+func TestHTTPHandlerSmallRequestReserve(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-unblock
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandlerWithRequestLimit(1)
+	handler.SetSmallRequestReserve(1, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/slow"))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	for len(handler.requestLocks) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, tt := range []struct {
+		body  string
+		code  int
+		sizes string
+	}{
+		{body: srv.URL + "/a\n" + srv.URL + "/b\n", code: http.StatusOK, sizes: "2\n2\n"},
+		{body: `{"method":"HEAD"}` + "\n" + srv.URL + "/a\n" + srv.URL + "/b", code: http.StatusOK, sizes: "2\n2\n"},
+		{body: srv.URL + "/a\n" + srv.URL + "/b\n" + srv.URL + "/c\n", code: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("small request test: body %q: got status %v want %v", tt.body, rr.Code, tt.code)
+		}
+		if got := rr.Body.String(); got != tt.sizes {
+			t.Errorf("small request test: body %q: got sizes %q want %q", tt.body, got, tt.sizes)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(srv.URL+"/a"), nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("small request test: query batch: got status %v want %v", rr.Code, http.StatusOK)
+	}
+	close(unblock)
+	<-done
+}
+
+func TestResponseMapCreateDuplicate(t *testing.T) {
+	const urlString = "http://example.com/"
+	resps := NewResponseMap()
+	var wg sync.WaitGroup
+	var created int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := resps.Create(urlString); err == nil {
+				atomic.AddInt32(&created, 1)
+			} else if !errors.Is(err, ErrDuplicateURL) {
+				t.Errorf("create test: unexpected error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 || resps.Len() != 1 {
+		t.Errorf("create test: URL created %d times, %d entries", created, resps.Len())
+	}
+	resps.SetResponse(urlString, Response{Size: 1})
+	if err := resps.Create(urlString); !errors.Is(err, ErrDuplicateURL) {
+		t.Errorf("create test: got error %v want %v", err, ErrDuplicateURL)
+	}
+	if resps.Map[urlString].Size != 1 {
+		t.Error("create test: duplicate reset the response")
+	}
+}
+
+func TestHTTPHandlerMaxBodySize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.Write(bytes.Repeat([]byte("x"), n))
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetMaxBodySize(100)
+	body := srv.URL + "/10\n" + srv.URL + "/100\n" + srv.URL + "/1000000\n"
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path      string
+		size      int64
+		truncated bool
+	}{
+		{path: "/10", size: 10},
+		{path: "/100", size: 100},
+		{path: "/1000000", size: 100, truncated: true},
+	} {
+		resp := resps.Map[srv.URL+tt.path]
+		if resp.Error != nil || resp.Size != tt.size || resp.BodyTruncated != tt.truncated {
+			t.Errorf("max body size test: %s: got size %d truncated %v error %v, want size %d truncated %v",
+				tt.path, resp.Size, resp.BodyTruncated, resp.Error, tt.size, tt.truncated)
+		}
+	}
+}
+
+func TestHTTPHandlerSetRequestTimeoutWhileServing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	// Under -race, setting the timeout while the requests read it must not be reported as a data race.
+	handler := NewHTTPHandler()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			handler.SetRequestTimeout(time.Duration(i+1) * time.Second)
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL)))
+			if rr.Code != http.StatusOK {
+				t.Errorf("concurrent timeout test: got status %d want %d", rr.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+	if timeout := handler.timeoutFor(srv.URL); timeout != 100*time.Second {
+		t.Errorf("concurrent timeout test: got timeout %v want the last one set", timeout)
+	}
+}
+
+func TestHTTPHandlerBatchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	handler.SetBatchTimeout(100 * time.Millisecond)
+	if err := handler.SetModeTimeout(OutputPrometheus, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		accept   string
+		respCode int
+		body     string
+	}{
+		// The slow URL is cancelled when the batch timeout expires.
+		{accept: "text/plain", respCode: http.StatusMultiStatus, body: "2\n-1\n"},
+		// The mode timeout takes precedence and leaves time for the slow URL.
+		{accept: "text/plain; version=0.0.4", respCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/fast\n"+srv.URL+"/slow"))
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("batch timeout test %q: handler returned wrong status code: got %v want %v", tt.accept, rr.Code, tt.respCode)
+		}
+		if tt.body != "" && rr.Body.String() != tt.body {
+			t.Errorf("batch timeout test %q: got body %q want %q", tt.accept, rr.Body.String(), tt.body)
+		}
+		if elapsed := time.Since(start); tt.respCode == http.StatusMultiStatus && elapsed > 250*time.Millisecond {
+			t.Errorf("batch timeout test %q: batch took %v", tt.accept, elapsed)
+		}
+	}
+}
+
+func TestHTTPHandlerCollapseWWW(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	body := "http://example.com/a\nhttp://www.example.com/a\nhttp://WWW.Example.com/a\nhttp://www.example.com/b\n"
+
+	for _, tt := range []struct {
+		collapse bool
+		keys     []string
+	}{
+		{collapse: false, keys: []string{"http://example.com/a", "http://www.example.com/a", "http://WWW.Example.com/a", "http://www.example.com/b"}},
+		{collapse: true, keys: []string{"http://example.com/a", "http://www.example.com/b"}},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		handler := NewHTTPHandler()
+		// All the hosts are served by the stub server.
+		handler.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+		}}
+		handler.SetCollapseWWW(tt.collapse)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := resps.Keys(OrderInput); !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("collapse www test %v: got URLs %v want %v", tt.collapse, keys, tt.keys)
+		}
+		if n := atomic.LoadInt32(&requests); int(n) != len(tt.keys) {
+			t.Errorf("collapse www test %v: got %d requests want %d", tt.collapse, n, len(tt.keys))
+		}
+		if skipped := resps.Summary().SkippedDuplicate; skipped != 4-len(tt.keys) {
+			t.Errorf("collapse www test %v: got %d duplicates want %d", tt.collapse, skipped, 4-len(tt.keys))
+		}
+	}
+}
+
+func TestHTTPHandlerFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(100 * time.Millisecond)
+	resps, err := handler.Fetch(context.Background(), []string{srv.URL + "/a", srv.URL + "/slow", srv.URL + "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := resps.Keys(OrderInput); !reflect.DeepEqual(keys, []string{srv.URL + "/a", srv.URL + "/slow"}) {
+		t.Errorf("fetch test: got URLs %v", keys)
+	}
+	if resp := resps.Map[srv.URL+"/a"]; resp.Error != nil || resp.Size != 2 {
+		t.Errorf("fetch test: got size %d error %v want size 2", resp.Size, resp.Error)
+	}
+	if resp := resps.Map[srv.URL+"/slow"]; !errors.Is(resp.Error, context.DeadlineExceeded) {
+		t.Errorf("fetch test: got error %v want %v", resp.Error, context.DeadlineExceeded)
+	}
+
+	if _, err := handler.Fetch(context.Background(), []string{"not a url"}); err == nil {
+		t.Error("fetch test: invalid URL unexpectedly accepted")
+	}
+	if _, err := handler.Fetch(context.Background(), nil); err == nil {
+		t.Error("fetch test: empty list unexpectedly accepted")
+	}
+
+	// The call waits for a request slot held by a served batch.
+	limited := NewHTTPHandlerWithRequestLimit(1)
+	limited.requestLocks <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := limited.Fetch(ctx, []string{srv.URL + "/a"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetch test: got error %v without a free request slot want %v", err, context.DeadlineExceeded)
+	}
+	<-limited.requestLocks
+	if _, err := limited.Fetch(context.Background(), []string{srv.URL + "/a"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,41 @@
+package httphandler
+
+import "time"
+
+// RequestLogger is called with the URL, the error and the duration of every completed request.
+// The error is nil for successful requests.
+type RequestLogger func(url string, err error, duration time.Duration)
+
+// SetLogger sets the function called for every completed request, including the redirects reported
+// as separate responses, e.g. to route the failures to an existing logging or alerting system.
+// It is called concurrently from the goroutines performing the requests, so it should not block.
+// nil, which is the default, disables logging.
+func (h *HTTPHandler) SetLogger(logger RequestLogger) {
+	h.logger = logger
+}
+
+// SetOnRequestComplete sets the callback called for every completed request like the logger,
+// with the status code, 0 if no response was received, the duration and the error, nil for
+// successful requests. It is meant to feed the metrics collectors of the application, e.g. counters
+// of requests, failures and timeouts, which satisfy errors.Is(err, context.DeadlineExceeded),
+// and a latency histogram. It is called concurrently and should not block. nil disables it.
+func (h *HTTPHandler) SetOnRequestComplete(callback func(status int, duration time.Duration, err error)) {
+	h.onRequest = callback
+}
+
+// SetOnBatchComplete sets the callback called once every batch has completed, with its summary,
+// its duration and the error it has failed with, if any. It is called for the batches served over HTTP,
+// the ones fetched with Fetch and the scheduled runs. nil disables it.
+func (h *HTTPHandler) SetOnBatchComplete(callback func(summary Summary, duration time.Duration, err error)) {
+	h.onBatch = callback
+}
+
+// reportRequest passes the completed request to the logger and the request callback if they are set.
+func (h *HTTPHandler) reportRequest(url string, r Response) {
+	if h.logger != nil {
+		h.logger(url, r.Error, r.Duration)
+	}
+	if h.onRequest != nil {
+		h.onRequest(r.StatusCode, r.Duration, r.Error)
+	}
+}
@@ -0,0 +1,101 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerLogger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	logged := make(map[string]error)
+	handler := NewHTTPHandler()
+	handler.SetLogger(func(url string, err error, duration time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged[url] = err
+		if duration <= 0 {
+			t.Errorf("logger test: no duration logged for %s", url)
+		}
+	})
+	failing := "http://127.0.0.1:1/"
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"\n"+failing))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logged) != 2 {
+		t.Fatalf("logger test: got logged requests %v want 2", logged)
+	}
+	if err, ok := logged[srv.URL]; !ok || err != nil {
+		t.Errorf("logger test: successful request logged with error %v", err)
+	}
+	if err := logged[failing]; err == nil {
+		t.Error("logger test: failed request logged without its error")
+	}
+}
+
+func TestHTTPHandlerMetricsCallbacks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var failures, timeouts, batches int
+	var summary Summary
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(100 * time.Millisecond)
+	handler.SetOnRequestComplete(func(status int, duration time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		statuses[status]++
+		if err != nil {
+			failures++
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			timeouts++
+		}
+	})
+	handler.SetOnBatchComplete(func(s Summary, duration time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		batches++
+		summary = s
+		if err != nil || duration <= 0 {
+			t.Errorf("metrics test: unexpected batch error %v or duration %v", err, duration)
+		}
+	})
+	body := srv.URL + "/ok\n" + srv.URL + "/error\n" + srv.URL + "/slow"
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusInternalServerError] != 1 || statuses[0] != 1 {
+		t.Errorf("metrics test: unexpected statuses %v", statuses)
+	}
+	if failures != 1 || timeouts != 1 {
+		t.Errorf("metrics test: got %d failures and %d timeouts want 1 and 1", failures, timeouts)
+	}
+	if batches != 1 || summary.Total != 3 || summary.Failed != 1 {
+		t.Errorf("metrics test: unexpected batches %d with summary %+v", batches, summary)
+	}
+}
@@ -0,0 +1,71 @@
+package httphandler
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrHostNotAllowed is recorded when the host of a URL, or of a redirect it leads to, is denied
+// or is not among the allowed hosts.
+var ErrHostNotAllowed = errors.New("host is not allowed")
+
+// SetAllowedHosts sets the only hosts the requests may be sent to. An entry is either a host name,
+// which matches exactly, or a wildcard like "*.example.com", which matches all of its subdomains
+// but not example.com itself. URLs with other hosts, and redirects to them, fail with ErrHostNotAllowed.
+// All hosts are allowed if the list is nil, which is the default.
+func (h *HTTPHandler) SetAllowedHosts(hosts []string) {
+	h.allowedHosts = normalizeHosts(hosts)
+}
+
+// SetDeniedHosts sets the hosts the requests may not be sent to, in the format of SetAllowedHosts.
+// URLs with these hosts, and redirects to them, fail with ErrHostNotAllowed even if the hosts are allowed.
+func (h *HTTPHandler) SetDeniedHosts(hosts []string) {
+	h.deniedHosts = normalizeHosts(hosts)
+}
+
+// normalizeHosts returns the host patterns in lower case, or nil if there are none.
+func normalizeHosts(hosts []string) []string {
+	if len(hosts) == 0 {
+		return nil
+	}
+	normalized := make([]string, len(hosts))
+	for i, host := range hosts {
+		normalized[i] = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	return normalized
+}
+
+// matchHost reports whether the host matches one of the host patterns.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+			if strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost returns ErrHostNotAllowed if the host of the URL is denied or is not allowed.
+func (h *HTTPHandler) checkHost(urlString string) error {
+	if h.allowedHosts == nil && h.deniedHosts == nil {
+		return nil
+	}
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return err
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if matchHost(h.deniedHosts, host) {
+		return fmt.Errorf("%w: %s is denied", ErrHostNotAllowed, host)
+	}
+	if h.allowedHosts != nil && !matchHost(h.allowedHosts, host) {
+		return fmt.Errorf("%w: %s is not in the allowed hosts", ErrHostNotAllowed, host)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerHostPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://localhost"+strings.TrimPrefix(r.Host, "127.0.0.1")+"/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	localURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/"
+
+	handler := NewHTTPHandler()
+	handler.SetAllowedHosts([]string{"127.0.0.1", "*.example.com"})
+	resps, err := handler.Fetch(context.Background(), []string{server.URL + "/", localURL, server.URL + "/redirect"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[server.URL+"/"]; resp.Error != nil || resp.Size != 2 {
+		t.Errorf("host policy test: allowed host failed with %v, size %d", resp.Error, resp.Size)
+	}
+	if resp := resps.Map[localURL]; !errors.Is(resp.Error, ErrHostNotAllowed) {
+		t.Errorf("host policy test: host outside of the allowed list got error %v want %v", resp.Error, ErrHostNotAllowed)
+	}
+	if resp := resps.Map[server.URL+"/redirect"]; !errors.Is(resp.Error, ErrHostNotAllowed) {
+		t.Errorf("host policy test: redirect outside of the allowed list got error %v want %v", resp.Error, ErrHostNotAllowed)
+	}
+
+	handler = NewHTTPHandler()
+	handler.SetDeniedHosts([]string{"LOCALHOST"})
+	resps, err = handler.Fetch(context.Background(), []string{server.URL + "/", localURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[server.URL+"/"]; resp.Error != nil {
+		t.Errorf("host policy test: host that is not denied failed with %v", resp.Error)
+	}
+	if resp := resps.Map[localURL]; !errors.Is(resp.Error, ErrHostNotAllowed) {
+		t.Errorf("host policy test: denied host got error %v want %v", resp.Error, ErrHostNotAllowed)
+	}
+
+	patterns := []string{"*.example.com", "example.org"}
+	for host, match := range map[string]bool{
+		"a.example.com":   true,
+		"a.b.example.com": true,
+		"example.com":     false,
+		"badexample.com":  false,
+		"example.org":     true,
+		"a.example.org":   false,
+	} {
+		if matchHost(patterns, host) != match {
+			t.Errorf("host policy test: %s got match %v want %v", host, !match, match)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package httphandler
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFailure is recorded for the URLs failed by the failure injection.
+var ErrInjectedFailure = errors.New("injected failure")
+
+// failureInjection randomly fails a fraction of the URLs without requesting them.
+type failureInjection struct {
+	rate   float64
+	status int
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// inject reports whether the URL is failed and returns its response.
+func (fi *failureInjection) inject() (Response, bool) {
+	if fi == nil {
+		return Response{}, false
+	}
+	fi.mu.Lock()
+	hit := fi.rng.Float64() < fi.rate
+	fi.mu.Unlock()
+	if !hit {
+		return Response{}, false
+	}
+	if fi.status == 0 {
+		return Response{Error: ErrInjectedFailure}, true
+	}
+	return Response{
+		Response: &http.Response{
+			Status:     fmt.Sprintf("%d %s", fi.status, http.StatusText(fi.status)),
+			StatusCode: fi.status,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+		},
+		StatusCode: fi.status,
+	}, true
+}
+
+// SetFailureInjection makes the handler fail the given fraction of the URLs at random without requesting them,
+// so that clients can test their handling of partial and failed batches. If status is zero, the URLs
+// are recorded as failed with ErrInjectedFailure, otherwise they are recorded as responses with the status.
+// Zero rate disables the injection. It is intended for testing only and must not be enabled in production.
+func (h *HTTPHandler) SetFailureInjection(rate float64, status int) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("invalid failure injection rate %v", rate)
+	}
+	if status != 0 && (status < 100 || status > 599) {
+		return fmt.Errorf("invalid failure injection status code %d", status)
+	}
+	if rate == 0 {
+		h.injection = nil
+		return nil
+	}
+	h.injection = &failureInjection{
+		rate:   rate,
+		status: status,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	return nil
+}
+
+// SetFailureInjectionSeed seeds the random choice of the failed URLs, making it reproducible.
+// It has no effect unless the failure injection is enabled.
+func (h *HTTPHandler) SetFailureInjectionSeed(seed int64) {
+	if h.injection == nil {
+		return
+	}
+	h.injection.mu.Lock()
+	h.injection.rng = rand.New(rand.NewSource(seed))
+	h.injection.mu.Unlock()
+}
@@ -0,0 +1,68 @@
+package httphandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPHandlerFailureInjection(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer srv.Close()
+
+	const total = 200
+	var body strings.Builder
+	for i := 0; i < total; i++ {
+		fmt.Fprintf(&body, "%s/%d\n", srv.URL, i)
+	}
+
+	handler := NewHTTPHandler()
+	if err := handler.SetFailureInjection(0.25, 0); err != nil {
+		t.Fatal(err)
+	}
+	handler.SetFailureInjectionSeed(1)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body.String()))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for _, resp := range resps.Map {
+		if errors.Is(resp.Error, ErrInjectedFailure) {
+			failed++
+		}
+	}
+	if failed < total*15/100 || failed > total*35/100 {
+		t.Errorf("failure injection test: got %d of %d URLs failed want about 25%%", failed, total)
+	}
+	if got := int(atomic.LoadInt32(&requests)); got != total-failed {
+		t.Errorf("failure injection test: got %d requests to the server want %d", got, total-failed)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	if err := handler.SetFailureInjection(1, http.StatusServiceUnavailable); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	resps, err = handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[srv.URL]; resp.Response == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("failure injection test: got %+v want forced status %d", resp, http.StatusServiceUnavailable)
+	}
+	if got := atomic.LoadInt32(&requests); got != 0 {
+		t.Errorf("failure injection test: got %d requests to the server want none", got)
+	}
+
+	if err := handler.SetFailureInjection(1.5, 0); err == nil {
+		t.Error("failure injection test: invalid rate unexpectedly accepted")
+	}
+}
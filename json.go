@@ -0,0 +1,116 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// jsonResult is the result of a single URL in the JSON output.
+type jsonResult struct {
+	// Size is -1 for failed requests.
+	Size int64 `json:"size"`
+	// Status is null if no response was received.
+	Status *int `json:"status"`
+	// Error is null for successful requests.
+	Error   *string          `json:"error"`
+	Preview string           `json:"preview,omitempty"`
+	Cookies []CapturedCookie `json:"cookies,omitempty"`
+	// Truncated is set if the body exceeded the maximum body size.
+	Truncated bool `json:"truncated,omitempty"`
+	// FinalURL is only set if the response was received from another URL, e.g. after redirects.
+	FinalURL string `json:"final_url,omitempty"`
+	// Scheme is only set to "http" if the https URL has failed and was requested over http instead.
+	Scheme string `json:"scheme,omitempty"`
+	// Entropy is only set if entropy computation is enabled and the request has succeeded.
+	Entropy *float64 `json:"entropy,omitempty"`
+	// DurationMS is only set if duration output is enabled.
+	DurationMS *float64 `json:"duration_ms,omitempty"`
+	// Hash is only set if the body hash is set and the request has succeeded.
+	Hash string `json:"hash,omitempty"`
+	// Attachment and Filename are only set for the responses with the attachment disposition.
+	Attachment bool   `json:"attachment,omitempty"`
+	Filename   string `json:"filename,omitempty"`
+	// WireSize, RemoteIP and RequestHeader are only set if they are recorded for the response,
+	// see the fields of Response.
+	WireSize      int64       `json:"wire_size,omitempty"`
+	RemoteIP      string      `json:"remote_ip,omitempty"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	// SLAViolated is set if the response was received after the SLA threshold.
+	SLAViolated bool `json:"sla_violated,omitempty"`
+	// DigestVerified is set if the body matches its Digest or Content-MD5 header.
+	DigestVerified bool `json:"digest_verified,omitempty"`
+	// HeadersTruncated is set if some of the response headers were dropped.
+	HeadersTruncated bool `json:"headers_truncated,omitempty"`
+	// BodySkipped is set if the body was not downloaded because of the content type filter.
+	BodySkipped bool `json:"body_skipped,omitempty"`
+}
+
+// newJSONResult converts the response to the URL to its JSON output representation.
+func newJSONResult(url string, resp Response) jsonResult {
+	result := jsonResult{
+		Size:             resp.Size,
+		Preview:          resp.Preview,
+		Cookies:          resp.SetCookies,
+		Truncated:        resp.BodyTruncated,
+		Attachment:       resp.Attachment,
+		Filename:         resp.AttachmentFilename,
+		WireSize:         resp.WireSize,
+		RemoteIP:         resp.RemoteIP,
+		RequestHeader:    resp.RequestHeader,
+		SLAViolated:      resp.SLAViolated,
+		DigestVerified:   resp.DigestVerified,
+		HeadersTruncated: resp.HeadersTruncated,
+		BodySkipped:      resp.BodySkipped,
+	}
+	if resp.FinalURL != url {
+		result.FinalURL = resp.FinalURL
+	}
+	if resp.HTTPSFallback {
+		result.Scheme = "http"
+	}
+	if resp.StatusCode != 0 {
+		status := resp.StatusCode
+		result.Status = &status
+	}
+	if resp.Error != nil {
+		message := resp.Error.Error()
+		result.Size, result.Error = -1, &message
+	}
+	return result
+}
+
+// writeJSON writes the responses as a JSON object keyed by URL, in the output order.
+func (h *HTTPHandler) writeJSON(w io.Writer, resps *ResponseMap) {
+	mustWrite(w, "{")
+	for i, key := range resps.Keys(h.outputOrder) {
+		if i > 0 {
+			mustWrite(w, ",")
+		}
+		resp := resps.Map[key]
+		result := newJSONResult(key, resp)
+		if h.computeEntropy && resp.Error == nil {
+			entropy := resp.Entropy
+			result.Entropy = &entropy
+		}
+		if h.durations {
+			ms := float64(resp.Duration) / float64(time.Millisecond)
+			result.DurationMS = &ms
+		}
+		if h.hashAlgo != nil && resp.Error == nil {
+			result.Hash = resp.BodyHash
+		}
+		mustWrite(w, string(mustMarshal(key))+":"+string(mustMarshal(result)))
+	}
+	mustWrite(w, "}\n")
+}
+
+// mustMarshal returns the JSON encoding of v and panics if it cannot be encoded.
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,123 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerJSONOutput(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprint(w, "body")
+	}))
+	defer srv.Close()
+	const failedURL = "http://127.0.0.1:1"
+
+	handler := NewHTTPHandler()
+	handler.SetBodyPreviewBytes(2)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/ok\n"+failedURL+"\n"+srv.URL+"/missing"))
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("JSON output test: unexpected content type %q", ct)
+	}
+	var results map[string]struct {
+		Size    int64   `json:"size"`
+		Status  *int    `json:"status"`
+		Error   *string `json:"error"`
+		Preview string  `json:"preview"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("JSON output test: got %d results want 3", len(results))
+	}
+	if ok := results[srv.URL+"/ok"]; ok.Size != 4 || ok.Status == nil || *ok.Status != http.StatusOK || ok.Error != nil || ok.Preview != "bo" {
+		t.Errorf("JSON output test: unexpected successful result %+v", ok)
+	}
+	if missing := results[srv.URL+"/missing"]; missing.Status == nil || *missing.Status != http.StatusNotFound {
+		t.Errorf("JSON output test: unexpected 404 result %+v", missing)
+	}
+	if failed := results[failedURL]; failed.Size != -1 || failed.Status != nil || failed.Error == nil || *failed.Error == "" {
+		t.Errorf("JSON output test: unexpected failed result %+v", failed)
+	}
+}
+
+func TestHTTPHandlerJSONOutputRecordedFields(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "body")
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name   string
+		record bool
+	}{
+		{name: "recorded", record: true},
+		{name: "not recorded", record: false},
+	} {
+		handler := NewHTTPHandler()
+		handler.SetCompressionAudit(tt.record)
+		handler.SetTraceCollection(tt.record)
+		handler.SetEchoRequestHeaders(tt.record)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var results map[string]map[string]json.RawMessage
+		if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		result := results[srv.URL]
+		for _, field := range []string{"wire_size", "remote_ip", "request_header"} {
+			if _, ok := result[field]; ok != tt.record {
+				t.Errorf("JSON fields test %s: got field %s %v want %v", tt.name, field, ok, tt.record)
+			}
+		}
+		if !tt.record {
+			continue
+		}
+		if got, want := string(result["remote_ip"]), `"127.0.0.1"`; got != want {
+			t.Errorf("JSON fields test %s: got remote_ip %s want %s", tt.name, got, want)
+		}
+		if got, want := string(result["wire_size"]), "4"; got != want {
+			t.Errorf("JSON fields test %s: got wire_size %s want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestJSONResultFlags(t *testing.T) {
+	for _, tt := range []struct {
+		field string
+		resp  Response
+	}{
+		{field: "sla_violated", resp: Response{SLAViolated: true}},
+		{field: "digest_verified", resp: Response{DigestVerified: true}},
+		{field: "headers_truncated", resp: Response{HeadersTruncated: true}},
+		{field: "body_skipped", resp: Response{BodySkipped: true}},
+	} {
+		for i, resp := range []Response{tt.resp, {}} {
+			data, err := json.Marshal(newJSONResult("http://example.com", resp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result map[string]json.RawMessage
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			// The flags are omitted unless they are set.
+			got, ok := result[tt.field]
+			if set := i == 0; ok != set || (ok && string(got) != "true") {
+				t.Errorf("JSON flags test %s: got %s present %v want present %v", tt.field, got, ok, set)
+			}
+		}
+	}
+}
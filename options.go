@@ -0,0 +1,53 @@
+package httphandler
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures the handler created by NewHTTPHandler. The options set the same values as
+// the corresponding setters, but before the handler can serve any request.
+type Option func(*HTTPHandler)
+
+// WithRequestLimit sets the limit of simultaneous requests, 100 by default.
+func WithRequestLimit(limit int) Option {
+	return func(h *HTTPHandler) {
+		h.requestLocks = make(chan struct{}, limit)
+	}
+}
+
+// WithRequestTimeout sets the timeout for each single request, like SetRequestTimeout.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(h *HTTPHandler) {
+		h.SetRequestTimeout(timeout)
+	}
+}
+
+// WithClient sets the client the requests are sent with, like SetClient.
+func WithClient(client *http.Client) Option {
+	return func(h *HTTPHandler) {
+		// No transport option can be set before the handler is created, so the client is always accepted.
+		h.SetClient(client)
+	}
+}
+
+// WithQueueTimeout sets how long a batch waits for a free request slot, like SetQueueTimeout.
+func WithQueueTimeout(timeout time.Duration) Option {
+	return func(h *HTTPHandler) {
+		h.SetQueueTimeout(timeout)
+	}
+}
+
+// WithBatchTimeout sets the timeout for a whole batch, like SetBatchTimeout.
+func WithBatchTimeout(timeout time.Duration) Option {
+	return func(h *HTTPHandler) {
+		h.SetBatchTimeout(timeout)
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the requests, like SetUserAgent.
+func WithUserAgent(userAgent string) Option {
+	return func(h *HTTPHandler) {
+		h.SetUserAgent(userAgent)
+	}
+}
@@ -0,0 +1,33 @@
+package httphandler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPHandlerOptions(t *testing.T) {
+	client := &http.Client{}
+	handler := NewHTTPHandler(
+		WithRequestLimit(3),
+		WithRequestTimeout(5*time.Second),
+		WithClient(client),
+		WithQueueTimeout(time.Second),
+		WithBatchTimeout(time.Minute),
+		WithUserAgent("probe/1.0"),
+	)
+	if cap(handler.requestLocks) != 3 {
+		t.Errorf("options test: got request limit %d want 3", cap(handler.requestLocks))
+	}
+	if handler.defaultTimeout() != 5*time.Second || handler.queueTimeout != time.Second || handler.batchTimeout != time.Minute {
+		t.Errorf("options test: unexpected timeouts %v, %v and %v", handler.defaultTimeout(), handler.queueTimeout, handler.batchTimeout)
+	}
+	if handler.client != client || handler.userAgent != "probe/1.0" {
+		t.Error("options test: client or user agent not set")
+	}
+
+	handler = NewHTTPHandler()
+	if cap(handler.requestLocks) != 100 || handler.defaultTimeout() != time.Second || handler.client != http.DefaultClient {
+		t.Error("options test: unexpected defaults without options")
+	}
+}
@@ -0,0 +1,328 @@
+package httphandler
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputMode is the format of the response body.
+type OutputMode int
+
+const (
+	// OutputText is a list of response sizes separated by new line characters.
+	OutputText OutputMode = iota
+	// OutputPrometheus is the Prometheus text exposition format with the size and the duration
+	// of each response labeled by URL. It is selected with the "text/plain; version=0.0.4" media type.
+	OutputPrometheus
+	// OutputTSV is a list of URLs and their response sizes separated by tab characters,
+	// one response per line. Failed requests are written with size -1.
+	OutputTSV
+	// OutputJSON is a JSON object with the size, the status code and the error of each response keyed by URL.
+	OutputJSON
+	// OutputFrames is a sequence of length-prefixed binary frames with the URL, the size and the status
+	// class of each response, for clients parsing huge batches. It is selected with the
+	// "application/vnd.httphandler.frames" media type.
+	OutputFrames
+)
+
+// OutputOrder is the order of the responses in the output.
+type OutputOrder int
+
+const (
+	// OrderUnspecified writes the responses in no particular order.
+	OrderUnspecified OutputOrder = iota
+	// OrderInput writes the responses in the order the URLs were listed in the request.
+	OrderInput
+	// OrderURL writes the responses sorted by URL.
+	OrderURL
+	// OrderCompletion writes the responses in the order they were received.
+	OrderCompletion
+)
+
+// outputMediaTypes maps the media types accepted from clients to the output modes.
+var outputMediaTypes = map[string]OutputMode{
+	"text/plain":                OutputText,
+	"text/tab-separated-values": OutputTSV,
+	"application/json":          OutputJSON,
+	framesMediaType:             OutputFrames,
+}
+
+// prometheusVersion is the version parameter of the text/plain media type selecting the Prometheus output.
+const prometheusVersion = "0.0.4"
+
+// valid reports whether the output mode is supported.
+func (m OutputMode) valid() bool {
+	if m == OutputPrometheus {
+		return true
+	}
+	for _, mode := range outputMediaTypes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateOutput selects the output mode for the Accept header value.
+// Media types are matched by their quality values; wildcards and an empty header select the fallback mode.
+// If none of the accepted media types is supported, ok is false.
+func negotiateOutput(accept string, fallback OutputMode) (mode OutputMode, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return fallback, true
+	}
+	bestQuality := 0.0
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, exists := params["q"]; exists {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+		entryMode, matched := matchMediaType(mediaType, params, fallback)
+		if !matched {
+			continue
+		}
+		mode, ok, bestQuality = entryMode, true, quality
+	}
+	return
+}
+
+// matchMediaType returns the output mode for a single accepted media type and its parameters.
+func matchMediaType(mediaType string, params map[string]string, fallback OutputMode) (OutputMode, bool) {
+	if mediaType == "text/plain" && params["version"] == prometheusVersion {
+		return OutputPrometheus, true
+	}
+	if mediaType == "*/*" {
+		return fallback, true
+	}
+	if mode, ok := outputMediaTypes[mediaType]; ok {
+		return mode, true
+	}
+	if strings.HasSuffix(mediaType, "/*") {
+		// The fallback mode is preferred, then the first matching media type in alphabetical order.
+		prefix := strings.TrimSuffix(mediaType, "*")
+		var first string
+		for candidate, mode := range outputMediaTypes {
+			if !strings.HasPrefix(candidate, prefix) {
+				continue
+			}
+			if mode == fallback {
+				return mode, true
+			}
+			if first == "" || candidate < first {
+				first = candidate
+			}
+		}
+		if first != "" {
+			return outputMediaTypes[first], true
+		}
+	}
+	return 0, false
+}
+
+// contentType returns the Content-Type of the output mode, or an empty string if it is detected from the body.
+func (m OutputMode) contentType() string {
+	switch m {
+	case OutputPrometheus:
+		return "text/plain; version=" + prometheusVersion + "; charset=utf-8"
+	case OutputTSV:
+		return "text/tab-separated-values; charset=utf-8"
+	case OutputJSON:
+		return "application/json"
+	case OutputFrames:
+		return framesMediaType
+	}
+	return ""
+}
+
+// writeText writes the size of each response on a separate line. Failed requests are written as -1.
+// If grouping by outcome is enabled, the successful and the failed responses are written in separate
+// sections, each starting with a label line, and the failures are followed by their reasons.
+// If grouping by body hash is enabled, the sizes are followed by a section listing the URLs with identical bodies.
+func (h *HTTPHandler) writeText(w io.Writer, resps *ResponseMap) {
+	h.writeLines(w, resps, false)
+}
+
+// writeTSV writes the URL and the size of each response on a separate line, like writeText.
+func (h *HTTPHandler) writeTSV(w io.Writer, resps *ResponseMap) {
+	h.writeLines(w, resps, true)
+}
+
+// writeLines writes the line-based output, with the sizes prefixed by their URLs if withURL is set.
+func (h *HTTPHandler) writeLines(w io.Writer, resps *ResponseMap, withURL bool) {
+	keys := resps.Keys(h.outputOrder)
+	h.writeSizes(w, resps, keys, withURL)
+	if h.groupByHash {
+		writeBodyHashGroups(w, resps, keys)
+	}
+}
+
+// writeSizes writes the sizes of the responses, grouped by outcome if enabled.
+// If repeating of duplicates is enabled, the size of a URL listed several times is written for each of them.
+func (h *HTTPHandler) writeSizes(w io.Writer, resps *ResponseMap, keys []string, withURL bool) {
+	write := func(key, s string) {
+		if withURL {
+			s = key + "\t" + s
+		}
+		for n := h.occurrences(resps, key); n > 0; n-- {
+			mustWrite(w, s)
+		}
+	}
+	if !h.groupByOutcome {
+		for _, key := range keys {
+			write(key, h.sizeLine(resps.Map[key]))
+		}
+		return
+	}
+	mustWrite(w, "# succeeded\n")
+	for _, key := range keys {
+		if resp := resps.Map[key]; resp.Error == nil {
+			write(key, h.sizeLine(resp))
+		}
+	}
+	mustWrite(w, "# failed\n")
+	for _, key := range keys {
+		if resp := resps.Map[key]; resp.Error != nil {
+			write(key, fmt.Sprintf("-1\t%s\n", oneLine(resp.Error.Error())))
+		}
+	}
+}
+
+// sizeLine returns the output line with the size of the response, or -1 if it has failed,
+// followed by the status code, the duration and the body hash if their columns are enabled.
+// The hash is "-" if there is none.
+func (h *HTTPHandler) sizeLine(resp Response) string {
+	size := int64(-1)
+	if resp.Error == nil {
+		size = resp.Size
+	}
+	line := strconv.FormatInt(size, 10)
+	if h.statusColumn {
+		line += "\t" + strconv.Itoa(resp.StatusCode)
+	}
+	if h.durations {
+		line += "\t" + formatMillis(resp.Duration)
+	}
+	if h.hashAlgo != nil {
+		bodyHash := resp.BodyHash
+		if resp.Error != nil || bodyHash == "" {
+			bodyHash = "-"
+		}
+		line += "\t" + bodyHash
+	}
+	return line + "\n"
+}
+
+// formatMillis formats the duration in milliseconds with microsecond precision, e.g. "12.345".
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// occurrences returns the number of times the size of the URL is written.
+func (h *HTTPHandler) occurrences(resps *ResponseMap, key string) int {
+	if !h.repeatDups {
+		return 1
+	}
+	return 1 + resps.duplicates[key]
+}
+
+// mustWrite writes the string and panics if the write fails.
+func mustWrite(w io.Writer, s string) {
+	if _, err := io.WriteString(w, s); err != nil {
+		panic(err)
+	}
+}
+
+// oneLine replaces the line breaks in the string so it fits on a single line of output.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// SetStatusColumn sets whether the sizes in the text and tab-separated outputs are followed by a tab
+// and the status code of the response, so that e.g. an empty 200 response can be told from a 500 one.
+// The status code is 0 if no response was received. It is disabled by default for compatibility.
+func (h *HTTPHandler) SetStatusColumn(enabled bool) {
+	h.statusColumn = enabled
+}
+
+// SetDurationOutput sets whether the time until the response headers were received, or until the request
+// has failed, is written for each URL: in milliseconds after a tab in the text and tab-separated outputs,
+// following the status column if it is enabled, and as duration_ms in the JSON output.
+func (h *HTTPHandler) SetDurationOutput(enabled bool) {
+	h.durations = enabled
+}
+
+// SetRepeatDuplicates sets whether the size of a URL listed several times in the request is written
+// once for each time it is listed, so that the output has a line for every listed URL. The URL is
+// still fetched only once and the repeated sizes follow its first one. By default the duplicates
+// are written once, so a list of identical URLs results in a single size.
+func (h *HTTPHandler) SetRepeatDuplicates(enabled bool) {
+	h.repeatDups = enabled
+}
+
+// SetGroupByOutcome sets whether the successful and the failed responses are written in separate
+// labeled sections, with the reasons of the failures, instead of a single list.
+func (h *HTTPHandler) SetGroupByOutcome(enabled bool) {
+	h.groupByOutcome = enabled
+}
+
+// SetOutputOrder sets the order of the responses in the output.
+// The default is OrderInput, so the sizes follow the order the URLs were listed in.
+func (h *HTTPHandler) SetOutputOrder(order OutputOrder) error {
+	if order < OrderUnspecified || order > OrderCompletion {
+		return fmt.Errorf("unsupported output order %d", order)
+	}
+	h.outputOrder = order
+	return nil
+}
+
+// SetAcceptFallback sets the output mode used when the client accepts any media type
+// or, unless strict Accept handling is enabled, none of the supported ones.
+func (h *HTTPHandler) SetAcceptFallback(mode OutputMode) error {
+	if !mode.valid() {
+		return fmt.Errorf("unsupported output mode %d", mode)
+	}
+	h.acceptFallback = mode
+	return nil
+}
+
+// SetModeTimeout bounds the total time of the batches answered in the output mode, so that the modes
+// the client receives nothing from until the end can be given a shorter ceiling. When the timeout
+// expires, the requests still in flight fail and the responses received so far are written.
+// Zero removes the bound for the mode, leaving the batch timeout set with SetBatchTimeout.
+func (h *HTTPHandler) SetModeTimeout(mode OutputMode, timeout time.Duration) error {
+	if !mode.valid() {
+		return fmt.Errorf("unsupported output mode %d", mode)
+	}
+	if h.modeTimeouts == nil {
+		h.modeTimeouts = make(map[OutputMode]time.Duration)
+	}
+	h.modeTimeouts[mode] = timeout
+	return nil
+}
+
+// batchTimeoutFor returns the bound of the total time of the batches answered in the output mode, or zero.
+func (h *HTTPHandler) batchTimeoutFor(mode OutputMode) time.Duration {
+	if timeout := h.modeTimeouts[mode]; timeout > 0 {
+		return timeout
+	}
+	return h.batchTimeout
+}
+
+// SetStrictAccept sets whether requests accepting none of the supported media types
+// are rejected with 406 Not Acceptable instead of receiving the fallback output mode.
+func (h *HTTPHandler) SetStrictAccept(strict bool) {
+	h.strictAccept = strict
+}
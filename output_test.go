@@ -0,0 +1,321 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegotiateOutput(t *testing.T) {
+	tests := []struct {
+		accept string
+		mode   OutputMode
+		ok     bool
+	}{
+		{accept: "", mode: OutputText, ok: true},
+		{accept: "*/*", mode: OutputText, ok: true},
+		{accept: "text/plain", mode: OutputText, ok: true},
+		{accept: "text/*;q=0.5, application/xml", mode: OutputText, ok: true},
+		{accept: "application/xml", ok: false},
+		{accept: "text/plain;q=0", ok: false},
+		{accept: "text/plain; version=0.0.4", mode: OutputPrometheus, ok: true},
+		{accept: "text/tab-separated-values", mode: OutputTSV, ok: true},
+		{accept: "text/plain;q=0.5, text/plain; version=0.0.4", mode: OutputPrometheus, ok: true},
+	}
+	for _, tt := range tests {
+		mode, ok := negotiateOutput(tt.accept, OutputText)
+		if ok != tt.ok || (ok && mode != tt.mode) {
+			t.Errorf("negotiate %q: got %v, %v want %v, %v", tt.accept, mode, ok, tt.mode, tt.ok)
+		}
+	}
+}
+
+func TestHTTPHandlerAccept(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		accept   string
+		strict   bool
+		respCode int
+		body     string
+	}{
+		{name: "matched", accept: "text/plain", strict: true, respCode: http.StatusOK, body: "2\n"},
+		{name: "unmatched strict", accept: "application/xml", strict: true, respCode: http.StatusNotAcceptable},
+		{name: "unmatched fallback", accept: "application/xml", respCode: http.StatusOK, body: "2\n"},
+	}
+	for _, tt := range tests {
+		handler := NewHTTPHandler()
+		handler.SetStrictAccept(tt.strict)
+		if err := handler.SetAcceptFallback(OutputText); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("accept test %s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.respCode)
+		}
+		if rr.Body.String() != tt.body {
+			t.Errorf("accept test %s: handler returned unexpected body: got %q want %q", tt.name, rr.Body.String(), tt.body)
+		}
+	}
+
+	if err := NewHTTPHandler().SetAcceptFallback(OutputMode(-1)); err == nil {
+		t.Error("accept test: unsupported fallback mode unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerOutputOrder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			time.Sleep(60 * time.Millisecond)
+		case "/b":
+			time.Sleep(30 * time.Millisecond)
+		}
+		fmt.Fprint(w, strings.Repeat("x", len(r.URL.Path)))
+	}))
+	defer srv.Close()
+	body := srv.URL + "/a\n" + srv.URL + "/ccc\n" + srv.URL + "/b\n" + srv.URL + "/dd\n"
+
+	tests := []struct {
+		order OutputOrder
+		want  string
+	}{
+		{order: OrderInput, want: "2\n4\n2\n3\n"},
+		{order: OrderURL, want: "2\n2\n4\n3\n"},
+	}
+	for _, tt := range tests {
+		handler := NewHTTPHandler()
+		if err := handler.SetOutputOrder(tt.order); err != nil {
+			t.Fatal(err)
+		}
+		for run := 0; run < 3; run++ {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Body.String() != tt.want {
+				t.Errorf("output order test: order %d, run %d: got %q want %q", tt.order, run, rr.Body.String(), tt.want)
+			}
+		}
+	}
+
+	// The input order is the default and failed requests keep their position.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\nhttp://127.0.0.1:1\n"+srv.URL+"/ccc\n"))
+	rr := httptest.NewRecorder()
+	NewHTTPHandler().ServeHTTP(rr, req)
+	if want := "2\n-1\n4\n"; rr.Body.String() != want {
+		t.Errorf("output order test: default order: got %q want %q", rr.Body.String(), want)
+	}
+
+	handler := NewHTTPHandler()
+	handler.SetOutputOrder(OrderCompletion)
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := resps.Keys(OrderCompletion)
+	if len(keys) != 4 || keys[2] != srv.URL+"/b" || keys[3] != srv.URL+"/a" {
+		t.Errorf("output order test: unexpected completion order %v", keys)
+	}
+
+	if err := handler.SetOutputOrder(OutputOrder(42)); err == nil {
+		t.Error("output order test: unsupported order unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerGroupByOutcome(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetGroupByOutcome(true)
+	handler.SetOutputOrder(OrderInput)
+	body := srv.URL + "/a\nhttp://127.0.0.1:1/b\n" + srv.URL + "/c\n"
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("group test: unexpected body %q", rr.Body.String())
+	}
+	if lines[0] != "# succeeded" || lines[1] != "2" || lines[2] != "2" || lines[3] != "# failed" {
+		t.Errorf("group test: unexpected sections %q", lines)
+	}
+	if !strings.HasPrefix(lines[4], "-1\t") || !strings.Contains(lines[4], "127.0.0.1:1") {
+		t.Errorf("group test: unexpected failure line %q", lines[4])
+	}
+}
+
+func TestHTTPHandlerModeTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	if err := handler.SetModeTimeout(OutputText, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		accept   string
+		respCode int
+	}{
+		// The text output is bounded by the mode timeout, so the slow URL fails.
+		{accept: "text/plain", respCode: http.StatusMultiStatus},
+		// The Prometheus output has no mode timeout and waits for the slow URL.
+		{accept: "text/plain; version=0.0.4", respCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/fast\n"+srv.URL+"/slow"))
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("mode timeout test %q: handler returned wrong status code: got %v want %v", tt.accept, rr.Code, tt.respCode)
+		}
+	}
+
+	if err := handler.SetModeTimeout(OutputMode(-1), time.Second); err == nil {
+		t.Error("mode timeout test: unsupported mode unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerRepeatDuplicates(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	const copies = 1000
+	body := strings.Repeat(srv.URL+"/same\n", copies) + srv.URL + "/other"
+	for _, tt := range []struct {
+		repeat bool
+		lines  []string
+	}{
+		{repeat: false, lines: []string{"5", "6"}},
+		{repeat: true, lines: append(strings.Split(strings.Repeat("5\n", copies), "\n")[:copies], "6")},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		handler := NewHTTPHandler()
+		handler.SetRepeatDuplicates(tt.repeat)
+		if err := handler.SetOutputOrder(OrderInput); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+		if strings.Join(lines, ",") != strings.Join(tt.lines, ",") {
+			t.Errorf("repeat duplicates test %v: got %d lines want %d", tt.repeat, len(lines), len(tt.lines))
+		}
+		if n := atomic.LoadInt32(&requests); n != 2 {
+			t.Errorf("repeat duplicates test %v: got %d requests want 2", tt.repeat, n)
+		}
+	}
+}
+
+func TestHTTPHandlerTSVOutput(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/a\nhttp://127.0.0.1:1\n"+srv.URL+"/b"))
+	req.Header.Set("Accept", "text/tab-separated-values")
+	rr := httptest.NewRecorder()
+	NewHTTPHandler().ServeHTTP(rr, req)
+	want := srv.URL + "/a\t2\nhttp://127.0.0.1:1\t-1\n" + srv.URL + "/b\t2\n"
+	if rr.Body.String() != want {
+		t.Errorf("TSV output test: got %q want %q", rr.Body.String(), want)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/tab-separated-values") {
+		t.Errorf("TSV output test: unexpected content type %q", ct)
+	}
+}
+
+func TestHTTPHandlerStatusColumn(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetStatusColumn(true)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/ok\n"+srv.URL+"/error\nhttp://127.0.0.1:1"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if want := "2\t200\n0\t500\n-1\t0\n"; rr.Body.String() != want {
+		t.Errorf("status column test: got %q want %q", rr.Body.String(), want)
+	}
+}
+
+func TestHTTPHandlerDurationOutput(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetStatusColumn(true)
+	handler.SetDurationOutput(true)
+	body := srv.URL + "\nhttp://127.0.0.1:1"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("duration output test: unexpected output %q", rr.Body.String())
+	}
+	for i, prefix := range []string{"2\t200\t", "-1\t0\t"} {
+		ms, err := strconv.ParseFloat(strings.TrimPrefix(lines[i], prefix), 64)
+		if !strings.HasPrefix(lines[i], prefix) || err != nil || ms <= 0 {
+			t.Errorf("duration output test: unexpected line %q", lines[i])
+		}
+		if i == 0 && ms < float64(delay/time.Millisecond) {
+			t.Errorf("duration output test: duration %vms is shorter than the server delay", ms)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var results map[string]struct {
+		DurationMS *float64 `json:"duration_ms"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for url, result := range results {
+		if result.DurationMS == nil || *result.DurationMS <= 0 {
+			t.Errorf("duration output test: missing JSON duration for %s in %s", url, rr.Body.String())
+		}
+	}
+}
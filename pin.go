@@ -0,0 +1,62 @@
+package httphandler
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrCertificatePinMismatch is recorded when none of the certificates presented by the server
+// matches the fingerprints pinned for its host.
+var ErrCertificatePinMismatch = errors.New("certificate does not match the pinned fingerprints")
+
+// SetPinnedCerts pins the SHA-256 fingerprints of the certificates accepted for the hosts, in addition to
+// the regular verification of the chain. The fingerprints are hex-encoded, optionally separated with colons.
+// A connection to a pinned host is only accepted if one of the certificates presented by the server
+// matches one of its fingerprints. Other hosts are not affected. The hosts are matched by the server name
+// sent in the handshake, so they must be host names rather than IP addresses.
+// It requires the client transport to be an *http.Transport and should be called before the handler
+// starts serving requests.
+func (h *HTTPHandler) SetPinnedCerts(pins map[string][]string) error {
+	pinned := make(map[string]map[string]bool, len(pins))
+	for host, fingerprints := range pins {
+		if net.ParseIP(host) != nil {
+			return fmt.Errorf("certificates cannot be pinned for IP address %s", host)
+		}
+		allowed := make(map[string]bool, len(fingerprints))
+		for _, fingerprint := range fingerprints {
+			fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+			if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("invalid SHA-256 fingerprint %q for host %s", fingerprint, host)
+			}
+			allowed[fingerprint] = true
+		}
+		pinned[strings.ToLower(host)] = allowed
+	}
+
+	return h.configureTLS(optPinnedCerts, func(config *tls.Config) {
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			allowed, ok := pinned[strings.ToLower(cs.ServerName)]
+			if !ok {
+				return nil
+			}
+			for _, cert := range cs.PeerCertificates {
+				fingerprint := sha256.Sum256(cert.Raw)
+				if allowed[hex.EncodeToString(fingerprint[:])] {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: %s", ErrCertificatePinMismatch, cs.ServerName)
+		}
+	})
+}
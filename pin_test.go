@@ -0,0 +1,64 @@
+package httphandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerPinnedCerts(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	fingerprint := sha256.Sum256(srv.Certificate().Raw)
+	correct := hex.EncodeToString(fingerprint[:])
+	incorrect := strings.Repeat("00", sha256.Size)
+	// The certificate of the test server is valid for example.com, which is dialed at the server address.
+	urlString := strings.Replace(srv.URL, "127.0.0.1", "example.com", 1)
+
+	for _, tt := range []struct {
+		name string
+		pin  string
+		ok   bool
+	}{
+		{name: "correct", pin: correct, ok: true},
+		{name: "incorrect", pin: incorrect, ok: false},
+	} {
+		handler := NewHTTPHandler()
+		// The client of the test server trusts its certificate.
+		handler.SetClient(srv.Client())
+		srv.Client().Transport.(*http.Transport).DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		}
+		if err := handler.SetPinnedCerts(map[string][]string{"example.com": {tt.pin}}); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(urlString))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[urlString]
+		if tt.ok && resp.Error != nil {
+			t.Errorf("pinned certs test %s: unexpected error %v", tt.name, resp.Error)
+		}
+		if !tt.ok && !errors.Is(resp.Error, ErrCertificatePinMismatch) {
+			t.Errorf("pinned certs test %s: got error %v want %v", tt.name, resp.Error, ErrCertificatePinMismatch)
+		}
+	}
+
+	if err := NewHTTPHandler().SetPinnedCerts(map[string][]string{"example.com": {"abc"}}); err == nil {
+		t.Error("pinned certs test: invalid fingerprint unexpectedly accepted")
+	}
+	if err := NewHTTPHandler().SetPinnedCerts(map[string][]string{"127.0.0.1": {correct}}); err == nil {
+		t.Error("pinned certs test: IP address unexpectedly accepted")
+	}
+}
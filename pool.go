@@ -0,0 +1,62 @@
+package httphandler
+
+import "context"
+
+// workerPool runs the requests of all the batches on a fixed number of goroutines.
+type workerPool struct {
+	jobs chan func()
+	size int
+}
+
+// newWorkerPool starts a pool of n workers.
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{jobs: make(chan func()), size: n}
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit waits for a free worker and runs the job on it.
+// It fails if the context is done before a worker becomes free.
+func (p *workerPool) submit(ctx context.Context, job func()) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop lets the workers exit once they finish their current jobs.
+func (p *workerPool) stop() {
+	close(p.jobs)
+}
+
+// SetGlobalWorkerCount sets the number of goroutines performing the requests of all the batches.
+// When set, the total number of simultaneous requests is bounded regardless of the number of batches,
+// and the URLs of a batch are read only as fast as the workers become free.
+// Zero restores the default of a goroutine per URL.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetGlobalWorkerCount(n int) {
+	if h.workers != nil {
+		h.workers.stop()
+		h.workers = nil
+	}
+	if n > 0 {
+		h.workers = newWorkerPool(n)
+	}
+}
+
+// run runs the job on the worker pool, or on a new goroutine if there is no pool.
+func (h *HTTPHandler) run(ctx context.Context, job func()) error {
+	if h.workers == nil {
+		go job()
+		return nil
+	}
+	return h.workers.submit(ctx, job)
+}
@@ -0,0 +1,45 @@
+package httphandler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerGlobalWorkerCount(t *testing.T) {
+	const workers = 3
+	srv := newConcurrencyServer(30 * time.Millisecond)
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetRequestTimeout(5 * time.Second)
+	handler.SetGlobalWorkerCount(workers)
+	defer handler.SetGlobalWorkerCount(0)
+
+	wg := new(sync.WaitGroup)
+	for batch := 0; batch < 3; batch++ {
+		wg.Add(1)
+		go func(batch int) {
+			defer wg.Done()
+			buf := bytes.NewBuffer(nil)
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(buf, "%s/%d/%d\n", srv.URL, batch, i)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", buf)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("worker pool test: batch %d returned wrong status code: got %v want %v", batch, rr.Code, http.StatusOK)
+			}
+		}(batch)
+	}
+	wg.Wait()
+
+	if max := srv.Max(); max > workers {
+		t.Errorf("worker pool test: %d simultaneous requests, %d workers", max, workers)
+	}
+}
@@ -0,0 +1,43 @@
+package httphandler
+
+import "unicode/utf8"
+
+// previewWriter keeps the first bytes written to it, up to its capacity.
+type previewWriter struct {
+	buf []byte
+}
+
+func newPreviewWriter(size int) *previewWriter {
+	return &previewWriter{buf: make([]byte, 0, size)}
+}
+
+func (pw *previewWriter) Write(p []byte) (int, error) {
+	if free := cap(pw.buf) - len(pw.buf); free > 0 {
+		if len(p) < free {
+			free = len(p)
+		}
+		pw.buf = append(pw.buf, p[:free]...)
+	}
+	return len(p), nil
+}
+
+// String returns the kept bytes without a trailing incomplete UTF-8 sequence.
+func (pw *previewWriter) String() string {
+	b := pw.buf
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				b = b[:i]
+			}
+			break
+		}
+	}
+	return string(b)
+}
+
+// SetBodyPreviewBytes sets the number of the first bytes of each response body recorded as its Preview,
+// e.g. to spot error pages. Only the preview is buffered while the body is streamed. The preview is cut
+// at a UTF-8 rune boundary, so it may be a few bytes shorter. Zero disables the previews.
+func (h *HTTPHandler) SetBodyPreviewBytes(n int) {
+	h.previewBytes = n
+}
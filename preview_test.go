@@ -0,0 +1,46 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerBodyPreview(t *testing.T) {
+	// "é" takes two bytes, so a 6-byte preview would cut it in half.
+	const body = "caféé and more"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		size    int
+		preview string
+	}{
+		{size: 0, preview: ""},
+		{size: 3, preview: "caf"},
+		{size: 5, preview: "café"},
+		{size: 6, preview: "café"},
+		{size: 7, preview: "caféé"},
+		{size: 100, preview: body},
+	}
+	for _, tt := range tests {
+		handler := NewHTTPHandler()
+		handler.SetBodyPreviewBytes(tt.size)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL]
+		if resp.Preview != tt.preview {
+			t.Errorf("preview test: %d bytes: got %q want %q", tt.size, resp.Preview, tt.preview)
+		}
+		if resp.Size != int64(len(body)) {
+			t.Errorf("preview test: %d bytes: got size %d want %d", tt.size, resp.Size, len(body))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package httphandler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// prometheusLabelEscaper escapes label values as required by the text exposition format.
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes the responses as metrics in the Prometheus text exposition format.
+// The size is only written for successful responses, the duration and the failure flag for all of them.
+func (h *HTTPHandler) writePrometheus(w io.Writer, resps *ResponseMap) {
+	keys := resps.Keys(h.outputOrder)
+	mustWrite(w, "# HELP httphandler_response_size_bytes Size of the response body.\n")
+	mustWrite(w, "# TYPE httphandler_response_size_bytes gauge\n")
+	for _, key := range keys {
+		if resp := resps.Map[key]; resp.Error == nil {
+			mustWrite(w, fmt.Sprintf("httphandler_response_size_bytes{url=\"%s\"} %d\n", prometheusLabelEscaper.Replace(key), resp.Size))
+		}
+	}
+	mustWrite(w, "# HELP httphandler_response_duration_seconds Time until the response headers were received or the request has failed.\n")
+	mustWrite(w, "# TYPE httphandler_response_duration_seconds gauge\n")
+	for _, key := range keys {
+		resp := resps.Map[key]
+		mustWrite(w, fmt.Sprintf("httphandler_response_duration_seconds{url=\"%s\"} %g\n", prometheusLabelEscaper.Replace(key), resp.Duration.Seconds()))
+	}
+	mustWrite(w, "# HELP httphandler_response_failed Whether the request has failed.\n")
+	mustWrite(w, "# TYPE httphandler_response_failed gauge\n")
+	for _, key := range keys {
+		failed := 0
+		if resps.Map[key].Error != nil {
+			failed = 1
+		}
+		mustWrite(w, fmt.Sprintf("httphandler_response_failed{url=\"%s\"} %d\n", prometheusLabelEscaper.Replace(key), failed))
+	}
+}
@@ -0,0 +1,106 @@
+package httphandler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// prometheusSample matches a sample line with a single url label in the text exposition format.
+var prometheusSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)\{url="((?:[^"\\]|\\.)*)"\} (\S+)$`)
+
+// parsePrometheus parses the samples of the text exposition format into metric name -> url -> value.
+// Every metric must be declared with a TYPE line before its samples.
+func parsePrometheus(t *testing.T, body string) map[string]map[string]float64 {
+	t.Helper()
+	unescape := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+	metrics := make(map[string]map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				t.Fatalf("invalid TYPE line %q", line)
+			}
+			metrics[fields[2]] = make(map[string]float64)
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := prometheusSample.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("invalid sample line %q", line)
+		}
+		samples, ok := metrics[match[1]]
+		if !ok {
+			t.Fatalf("sample of undeclared metric %q", line)
+		}
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Fatalf("invalid sample value %q: %v", line, err)
+		}
+		samples[unescape.Replace(match[2])] = value
+	}
+	return metrics
+}
+
+func TestHTTPHandlerPrometheusOutput(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	req.Header.Set("Accept", "text/plain; version=0.0.4")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("prometheus output test: unexpected status %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("prometheus output test: unexpected content type %q", ct)
+	}
+	metrics := parsePrometheus(t, rr.Body.String())
+	if size := metrics["httphandler_response_size_bytes"][srv.URL]; size != 5 {
+		t.Errorf("prometheus output test: got size %v want 5", size)
+	}
+	if _, ok := metrics["httphandler_response_duration_seconds"][srv.URL]; !ok {
+		t.Error("prometheus output test: duration is missing")
+	}
+}
+
+func TestWritePrometheusEscaping(t *testing.T) {
+	const (
+		okURL     = `http://example.com/?q="a\b"`
+		failedURL = "http://example.com/\nfailed"
+	)
+	resps := NewResponseMap()
+	resps.SetResponse(okURL, Response{Response: &http.Response{StatusCode: http.StatusOK}, Size: 3, Duration: 1500 * time.Millisecond})
+	resps.SetResponse(failedURL, Response{Error: errors.New("timeout")})
+
+	var buf strings.Builder
+	NewHTTPHandler().writePrometheus(&buf, resps)
+	metrics := parsePrometheus(t, buf.String())
+	if size := metrics["httphandler_response_size_bytes"][okURL]; size != 3 {
+		t.Errorf("prometheus escaping test: got size %v want 3", size)
+	}
+	if _, ok := metrics["httphandler_response_size_bytes"][failedURL]; ok {
+		t.Error("prometheus escaping test: size of a failed response is written")
+	}
+	if duration := metrics["httphandler_response_duration_seconds"][okURL]; duration != 1.5 {
+		t.Errorf("prometheus escaping test: got duration %v want 1.5", duration)
+	}
+	if failed := metrics["httphandler_response_failed"][failedURL]; failed != 1 {
+		t.Errorf("prometheus escaping test: got failed flag %v for the failed URL", failed)
+	}
+}
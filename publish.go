@@ -0,0 +1,66 @@
+package httphandler
+
+import (
+	"context"
+	"log"
+)
+
+// ResultPublisher publishes the result of each request, e.g. to a message bus.
+// Implementations for particular message buses are outside of this package.
+type ResultPublisher interface {
+	Publish(ctx context.Context, url string, r Response) error
+}
+
+// publishQueueSize is the number of results waiting to be published.
+const publishQueueSize = 1024
+
+// publication is a result waiting to be published.
+type publication struct {
+	url  string
+	resp Response
+}
+
+// SetResultPublisher sets the publisher of the request results. Results are queued without blocking
+// the requests and published one by one in the order of completion. If the queue is full, the result
+// is dropped. Dropped results and publish errors are logged. nil disables publishing.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetResultPublisher(publisher ResultPublisher) {
+	if h.publications != nil {
+		close(h.publications)
+		h.publications = nil
+	}
+	if publisher == nil {
+		return
+	}
+	queue := make(chan publication, publishQueueSize)
+	go func() {
+		for p := range queue {
+			publishOne(publisher, p)
+		}
+	}()
+	h.publications = queue
+}
+
+// publishOne publishes a single result, logging the error or the panic of the publisher.
+func publishOne(publisher ResultPublisher, p publication) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("httphandler: panic publishing result of %s: %v", p.url, r)
+		}
+	}()
+	if err := publisher.Publish(context.Background(), p.url, p.resp); err != nil {
+		log.Printf("httphandler: publish result of %s: %v", p.url, err)
+	}
+}
+
+// publish queues the result for publishing if the publisher is set.
+func (h *HTTPHandler) publish(url string, r Response) {
+	if h.publications == nil {
+		return
+	}
+	select {
+	case h.publications <- publication{url: url, resp: r}:
+	default:
+		log.Printf("httphandler: publish queue is full, result of %s dropped", url)
+	}
+}
@@ -0,0 +1,61 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePublisher records the published URLs.
+type fakePublisher struct {
+	mu        sync.Mutex
+	published map[string]int
+	done      chan struct{}
+	want      int
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, url string, r Response) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published[url]++
+	p.want--
+	if p.want == 0 {
+		close(p.done)
+	}
+	return nil
+}
+
+func TestHTTPHandlerResultPublisher(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	urls := []string{srv.URL + "/a", srv.URL + "/b", "http://127.0.0.1:1/c"}
+	publisher := &fakePublisher{published: make(map[string]int), done: make(chan struct{}), want: len(urls)}
+	handler := NewHTTPHandler()
+	handler.SetResultPublisher(publisher)
+	defer handler.SetResultPublisher(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Join(urls, "\n")))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	select {
+	case <-publisher.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("publisher test: not all the results were published")
+	}
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	for _, url := range urls {
+		if n := publisher.published[url]; n != 1 {
+			t.Errorf("publisher test: %s published %d times want 1", url, n)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SetQueueTimeout sets how long a batch waits for a free request slot when the concurrent request
+// limit is reached, before it is rejected with 429 Too Many Requests. Zero rejects it immediately.
+func (h *HTTPHandler) SetQueueTimeout(timeout time.Duration) {
+	h.queueTimeout = timeout
+}
+
+// SetRetryAfter sets the delay advertised in the Retry-After header of the 429 Too Many Requests responses
+// and of the 503 Service Unavailable responses of the paused handler, rounded up to whole seconds.
+// Zero, which is the default, omits the header.
+func (h *HTTPHandler) SetRetryAfter(delay time.Duration) {
+	h.retryAfter = delay
+}
+
+// SetServerTiming sets whether the time each batch has waited for a request slot is sent
+// to the clients in the Server-Timing header, e.g. "queue;dur=12.5" for 12.5 milliseconds.
+func (h *HTTPHandler) SetServerTiming(enabled bool) {
+	h.serverTiming = enabled
+}
+
+// queueWaitKey is the context key of the time the served batch has waited for a request slot.
+type queueWaitKey struct{}
+
+// waitRequest waits for a free request slot until the queue timeout expires or the client goes away.
+func (h *HTTPHandler) waitRequest(r *http.Request) (release func(), ok bool) {
+	if h.queueTimeout <= 0 {
+		return nil, false
+	}
+	timer := time.NewTimer(h.queueTimeout)
+	defer timer.Stop()
+	select {
+	case h.requestLocks <- struct{}{}:
+		return func() { <-h.requestLocks }, true
+	case <-timer.C:
+		return nil, false
+	case <-r.Context().Done():
+		return nil, false
+	}
+}
+
+// writeRetryAfter sets the Retry-After header of the rejected batch if the delay is set.
+func (h *HTTPHandler) writeRetryAfter(w http.ResponseWriter) {
+	if h.retryAfter > 0 {
+		seconds := (h.retryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+}
+
+// writeServerTiming sets the Server-Timing header with the time the batch has waited for a request slot.
+func (h *HTTPHandler) writeServerTiming(w http.ResponseWriter, wait time.Duration) {
+	if h.serverTiming {
+		w.Header().Set("Server-Timing", fmt.Sprintf("queue;dur=%.3f", float64(wait)/float64(time.Millisecond)))
+	}
+}
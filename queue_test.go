@@ -0,0 +1,75 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerQueueWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		queueTimeout time.Duration
+		respCode     int
+	}{
+		{queueTimeout: time.Second, respCode: http.StatusOK},
+		{queueTimeout: 20 * time.Millisecond, respCode: http.StatusTooManyRequests},
+	} {
+		handler := NewHTTPHandlerWithRequestLimit(1)
+		handler.SetQueueTimeout(tt.queueTimeout)
+		handler.SetServerTiming(true)
+		handler.SetRetryAfter(1500 * time.Millisecond)
+		var mu sync.Mutex
+		var maxWait time.Duration
+		handler.SetOnBatchComplete(func(summary Summary, duration time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if summary.QueueWait > maxWait {
+				maxWait = summary.QueueWait
+			}
+		})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/slow"))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		for len(handler.requestLocks) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+"/fast"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		<-done
+		if rr.Code != tt.respCode {
+			t.Errorf("queue test with timeout %v: handler returned wrong status code: got %v want %v", tt.queueTimeout, rr.Code, tt.respCode)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); (rr.Code == http.StatusTooManyRequests) != (retryAfter == "2") {
+			t.Errorf("queue test with timeout %v: unexpected Retry-After %q with status %d", tt.queueTimeout, retryAfter, rr.Code)
+		}
+		timing := rr.Header().Get("Server-Timing")
+		dur, err := strconv.ParseFloat(strings.TrimPrefix(timing, "queue;dur="), 64)
+		if err != nil || dur <= 0 {
+			t.Errorf("queue test with timeout %v: unexpected Server-Timing %q", tt.queueTimeout, timing)
+		}
+		// The queued batch reports its wait for the slow batch to the hooks.
+		mu.Lock()
+		if rr.Code == http.StatusOK && maxWait < 50*time.Millisecond {
+			t.Errorf("queue test with timeout %v: got queue wait %v want at least 50ms", tt.queueTimeout, maxWait)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package httphandler
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// SetSmallRequestReserve reserves count request slots for the batches listing at most urlThreshold URLs.
+// When all the regular slots are taken, such batches are admitted to the reserved slots instead of
+// being rejected with 429 Too Many Requests, so cheap requests are still served during congestion.
+// To count the URLs of a POST batch, up to urlThreshold+1 lines of its body are read ahead, which makes
+// the server send 100 Continue to the clients expecting it. Batches referencing a file and sitemaps are never small.
+// A zero count disables the reserve. It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetSmallRequestReserve(count, urlThreshold int) {
+	if count <= 0 || urlThreshold <= 0 {
+		h.smallReserve = nil
+		return
+	}
+	h.smallReserve = make(chan struct{}, count)
+	h.smallThreshold = urlThreshold
+}
+
+// acquireSmall takes a reserved slot if the batch is small and a reserved slot is free.
+// The returned request replaces r, since a part of its body may have been read ahead.
+func (h *HTTPHandler) acquireSmall(r *http.Request) (req *http.Request, release func(), ok bool) {
+	if h.smallReserve == nil {
+		return r, nil, false
+	}
+	var small bool
+	if isQueryBatch(r) {
+		small = len(r.URL.Query()["url"]) <= h.smallThreshold
+	} else {
+		small, r = h.countAhead(r)
+	}
+	if !small {
+		return r, nil, false
+	}
+	select {
+	case h.smallReserve <- struct{}{}:
+		return r, func() { <-h.smallReserve }, true
+	default:
+		return r, nil, false
+	}
+}
+
+// countAhead reads the body of the request until it is known whether it lists at most the threshold
+// number of URLs. The returned request has the body with the read lines put back.
+func (h *HTTPHandler) countAhead(r *http.Request) (small bool, req *http.Request) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && sitemapMediaTypes[mediaType] {
+		return false, r
+	}
+	reader := bufio.NewReader(r.Body)
+	var ahead bytes.Buffer
+	lines := 0
+	for lines <= h.smallThreshold {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			first := ahead.Len() == 0
+			ahead.Write(line)
+			switch {
+			case first && line[0] == optionsPrefix:
+			case h.allowFileRefs && lines == 0 && line[0] == fileRefPrefix, lines == 0 && line[0] == sitemapPrefix:
+				lines = h.smallThreshold + 1
+			default:
+				lines++
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	req = r.Clone(r.Context())
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&ahead, reader), r.Body}
+	return lines <= h.smallThreshold, req
+}
@@ -0,0 +1,139 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// retryBudget throttles the retries within a batch.
+// Every request added to the batch raises the budget by a fraction of a retry,
+// every retry spends a whole token and every success refunds a fraction of a token,
+// never exceeding the budget raised by the requests.
+type retryBudget struct {
+	mu       sync.Mutex
+	fraction float64
+	tokens   float64
+	max      float64
+}
+
+// newRetryBudget creates a budget allowing retries for the fraction of the requests.
+// Zero fraction creates no budget; a nil budget allows all the retries.
+func newRetryBudget(fraction float64) *retryBudget {
+	if fraction <= 0 {
+		return nil
+	}
+	return &retryBudget{fraction: fraction}
+}
+
+// addRequest raises the budget for a request added to the batch.
+func (b *retryBudget) addRequest() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.max += b.fraction
+	b.tokens += b.fraction
+}
+
+// succeeded refunds a fraction of a token for a successful request.
+func (b *retryBudget) succeeded() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.fraction
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// allowRetry spends a token if one is available and reports whether a retry is allowed.
+func (b *retryBudget) allowRetry() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Tolerate the rounding errors accumulated by adding the fractions.
+	if b.tokens < 1-1e-9 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// SetRetryBudget caps the retries within a batch to the fraction of the number of its requests,
+// e.g. 0.2 allows 2 retries for a batch of 10 URLs. Successful requests partially refill the budget.
+// When the budget is exhausted, requests fail on their first error. Zero disables the budget.
+func (h *HTTPHandler) SetRetryBudget(fraction float64) error {
+	if fraction < 0 {
+		return fmt.Errorf("invalid retry budget %v", fraction)
+	}
+	h.retryBudget = fraction
+	return nil
+}
+
+// SetRetries sets the number of times a request failing with a transport error, like a connection reset
+// or a DNS failure, is retried. Responses with any status code are not retried, nor are the requests
+// that have timed out, TLS failures and undecodable responses. The first retry waits for the backoff,
+// and every next one waits twice as long as the previous one. The retries are limited by the retry budget
+// and stop when the batch is cancelled. Only the error of the last attempt is recorded.
+func (h *HTTPHandler) SetRetries(count int, backoff time.Duration) error {
+	if count < 0 || backoff < 0 {
+		return fmt.Errorf("invalid retries %d with backoff %v", count, backoff)
+	}
+	h.retries = count
+	h.retryBackoff = backoff
+	return nil
+}
+
+// fetchWithRetries performs request on a single URL of the batch, retrying the transport errors.
+// The timeout of the URL bounds all the attempts together with the backoff between them.
+func (h *HTTPHandler) fetchWithRetries(b *batch, url string) (r Response, hops []redirectHop) {
+	timeout := h.timeoutFor(url)
+	if b.cfg.timeout > 0 {
+		timeout = b.cfg.timeout
+	}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(b.ctx, deadline.Add(h.drainGrace))
+	defer cancel()
+	backoff := h.retryBackoff
+	for attempt := 0; ; attempt++ {
+		r, hops = h.fetchWithFallback(ctx, url, b.cfg, deadline)
+		if r.Error == nil {
+			b.budget.succeeded()
+			return r, hops
+		}
+		if attempt >= h.retries || !retryable(r.Error) || time.Now().Add(backoff).After(deadline) ||
+			!b.budget.allowRetry() {
+			return r, hops
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return r, hops
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether the request failure may be transient.
+func retryable(err error) bool {
+	for _, permanent := range []error{
+		context.DeadlineExceeded, context.Canceled,
+		ErrTLSFailure, ErrCertificatePinMismatch, ErrUnsupportedTransferEncoding, ErrDigestMismatch, ErrDecompressionBomb,
+		ErrContentDecoding, ErrBlockedAddress, ErrHostNotAllowed,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(0.2)
+	for i := 0; i < 10; i++ {
+		budget.addRequest()
+	}
+	retries := 0
+	for i := 0; i < 10; i++ {
+		if budget.allowRetry() {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Errorf("retry budget test: got %d retries want 2", retries)
+	}
+
+	for i := 0; i < 5; i++ {
+		budget.succeeded()
+	}
+	if !budget.allowRetry() {
+		t.Error("retry budget test: successes did not refill the budget")
+	}
+	for i := 0; i < 100; i++ {
+		budget.succeeded()
+	}
+	retries = 0
+	for i := 0; i < 10; i++ {
+		if budget.allowRetry() {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Errorf("retry budget test: refilled budget allowed %d retries want 2", retries)
+	}
+
+	unlimited := newRetryBudget(0)
+	if !unlimited.allowRetry() {
+		t.Error("retry budget test: disabled budget denied a retry")
+	}
+	if err := NewHTTPHandler().SetRetryBudget(-1); err == nil {
+		t.Error("retry budget test: negative budget unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerRetryBudgetMassFailure(t *testing.T) {
+	var requests int32
+	// Every connection is reset, so all the URLs keep failing with a retryable error.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	const count = 50
+	var urls []string
+	for i := 0; i < count; i++ {
+		urls = append(urls, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	for _, tt := range []struct {
+		budget  float64
+		retries int32
+	}{
+		{budget: 0.1, retries: 5},
+		{budget: 0.25, retries: 12},
+		// Without a budget, every URL is retried up to the limit.
+		{budget: 0, retries: 2 * count},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		handler := NewHTTPHandler()
+		// More retries per URL than the whole budget, so that the last failing URL can spend what is left.
+		limit := 2
+		if tt.budget > 0 {
+			limit = 20
+		}
+		if err := handler.SetRetries(limit, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.SetRetryBudget(tt.budget); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Join(urls, "\n")))
+		if _, err := handler.executeAllRequests(req); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := atomic.LoadInt32(&requests), count+tt.retries; got != want {
+			t.Errorf("mass failure test with budget %v: got %d requests want %d", tt.budget, got, want)
+		}
+	}
+}
+
+func TestHTTPHandlerRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The first two connections are reset before the response.
+		if n <= 2 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path     string
+		retries  int
+		budget   float64
+		ok       bool
+		requests int32
+	}{
+		{path: "/flaky", retries: 2, ok: true, requests: 3},
+		{path: "/flaky", retries: 1, requests: 2},
+		// The budget allows half a retry for a single URL.
+		{path: "/flaky", retries: 2, budget: 0.5, requests: 1},
+		// Status codes are not retried.
+		{path: "/error", retries: 2, ok: true, requests: 1},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		handler := NewHTTPHandler()
+		// A fresh transport makes sure no connection is reused, which the transport could retry itself.
+		handler.SetClient(&http.Client{Transport: &http.Transport{}})
+		if err := handler.SetRetries(tt.retries, 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.SetRetryBudget(tt.budget); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL+tt.path))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL+tt.path]
+		if (resp.Error == nil) != tt.ok {
+			t.Errorf("retries test %+v: got error %v", tt, resp.Error)
+		}
+		if n := atomic.LoadInt32(&requests); n != tt.requests {
+			t.Errorf("retries test %+v: got %d requests want %d", tt, n, tt.requests)
+		}
+	}
+
+	if err := NewHTTPHandler().SetRetries(-1, 0); err == nil {
+		t.Error("retries test: negative count unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerRetriesTimeout(t *testing.T) {
+	// Every connection is reset shortly before the timeout.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetClient(&http.Client{Transport: &http.Transport{}})
+	handler.SetRequestTimeout(200 * time.Millisecond)
+	if err := handler.SetRetries(3, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+	start := time.Now()
+	resps, err := handler.executeAllRequests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The retries share the timeout of the URL instead of each getting a timeout of their own.
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("retries timeout test: got %v want at most 350ms", elapsed)
+	}
+	if resps.Map[srv.URL].Error == nil {
+		t.Error("retries timeout test: got no error")
+	}
+}
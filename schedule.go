@@ -0,0 +1,195 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// schedulePathPrefix starts the path of the scheduled batch results endpoint, /schedule/{id}/results.
+const schedulePathPrefix = "/schedule/"
+
+// defaultMaxSchedules is the number of batches that can be scheduled unless set with SetMaxSchedules.
+const defaultMaxSchedules = 16
+
+// ErrTooManySchedules is returned by Schedule when the maximum number of batches is already scheduled.
+var ErrTooManySchedules = errors.New("too many scheduled batches")
+
+// scheduledBatch is a batch fetched every interval, keeping the results of its latest run.
+type scheduledBatch struct {
+	urls     []string
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu      sync.Mutex
+	latest  *ResponseMap
+	updated time.Time
+}
+
+// scheduleStore keeps the scheduled batches by their ID.
+type scheduleStore struct {
+	mu      sync.Mutex
+	max     int
+	batches map[string]*scheduledBatch
+}
+
+// SetMaxSchedules sets the maximum number of batches scheduled at the same time, 16 by default.
+// Zero or a negative number restores the default.
+func (h *HTTPHandler) SetMaxSchedules(n int) {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+	h.schedules.max = n
+}
+
+// Schedule fetches the URLs every interval, starting immediately, for lightweight synthetic monitoring.
+// The results of the latest completed run are returned by LatestResults and as JSON by GET /schedule/{id}/results.
+// A run is fetched like a batch served by the handler: it takes a slot of the concurrent request limit,
+// waiting for one if needed, all the handler options apply, and it is skipped while the handler is paused.
+// Runs never overlap; a run taking longer than the interval delays the next one.
+// Scheduling a batch with the ID of a scheduled one replaces it. At most 16 batches are scheduled
+// at the same time unless set with SetMaxSchedules, and ErrTooManySchedules is returned beyond that.
+func (h *HTTPHandler) Schedule(id string, urls []string, interval time.Duration) error {
+	if id == "" || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid schedule ID %q", id)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid schedule interval %v", interval)
+	}
+	if len(urls) == 0 {
+		return errors.New("empty URL list")
+	}
+	for _, urlString := range urls {
+		if err := h.validateURL(urlString); err != nil {
+			return err
+		}
+	}
+
+	ss := &h.schedules
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sb, ok := ss.batches[id]; ok {
+		sb.stop()
+		delete(ss.batches, id)
+	}
+	max := ss.max
+	if max <= 0 {
+		max = defaultMaxSchedules
+	}
+	if len(ss.batches) >= max {
+		return fmt.Errorf("%w: %d", ErrTooManySchedules, max)
+	}
+	if ss.batches == nil {
+		ss.batches = make(map[string]*scheduledBatch)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sb := &scheduledBatch{
+		urls:     append([]string(nil), urls...),
+		interval: interval,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	ss.batches[id] = sb
+	go h.runSchedule(ctx, sb)
+	return nil
+}
+
+// Unschedule stops fetching the scheduled batch and discards its results. A run in progress is cancelled.
+// It reports whether the batch was scheduled.
+func (h *HTTPHandler) Unschedule(id string) bool {
+	ss := &h.schedules
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sb, ok := ss.batches[id]
+	if ok {
+		sb.stop()
+		delete(ss.batches, id)
+	}
+	return ok
+}
+
+// LatestResults returns the responses of the latest completed run of the scheduled batch.
+// It reports false if the batch is not scheduled or has not completed a run yet.
+func (h *HTTPHandler) LatestResults(id string) (*ResponseMap, bool) {
+	resps, _, ok := h.latestResults(id)
+	return resps, ok
+}
+
+// latestResults returns the responses of the latest completed run of the scheduled batch and its completion time.
+func (h *HTTPHandler) latestResults(id string) (*ResponseMap, time.Time, bool) {
+	h.schedules.mu.Lock()
+	sb, ok := h.schedules.batches[id]
+	h.schedules.mu.Unlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.latest, sb.updated, sb.latest != nil
+}
+
+// stop cancels the scheduled batch and waits for its goroutine to exit.
+func (sb *scheduledBatch) stop() {
+	sb.cancel()
+	<-sb.done
+}
+
+// runSchedule fetches the scheduled batch every interval until its context is cancelled.
+func (h *HTTPHandler) runSchedule(ctx context.Context, sb *scheduledBatch) {
+	defer close(sb.done)
+	ticker := time.NewTicker(sb.interval)
+	defer ticker.Stop()
+	for {
+		h.runScheduled(ctx, sb)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runScheduled fetches a single run of the scheduled batch on a request slot and records its results.
+// The results of failed or cancelled runs are not recorded.
+func (h *HTTPHandler) runScheduled(ctx context.Context, sb *scheduledBatch) {
+	if atomic.LoadInt32(&h.paused) != 0 {
+		return
+	}
+	resps, err := h.Fetch(ctx, sb.urls)
+	if err != nil || ctx.Err() != nil {
+		return
+	}
+	sb.mu.Lock()
+	sb.latest, sb.updated = resps, time.Now()
+	sb.mu.Unlock()
+}
+
+// scheduleResultsID returns the schedule ID if the request is for the scheduled batch results endpoint.
+func scheduleResultsID(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet || isQueryBatch(r) || !strings.HasPrefix(r.URL.Path, schedulePathPrefix) {
+		return "", false
+	}
+	id, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, schedulePathPrefix), "/")
+	if !ok || id == "" || rest != "results" {
+		return "", false
+	}
+	return id, true
+}
+
+// writeScheduleResults responds with the latest results of the scheduled batch as JSON,
+// or 404 Not Found if it is not scheduled or has not completed a run yet.
+func (h *HTTPHandler) writeScheduleResults(w http.ResponseWriter, id string) {
+	resps, updated, ok := h.latestResults(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	h.writeJSON(w, resps)
+}
@@ -0,0 +1,72 @@
+package httphandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerSchedule(t *testing.T) {
+	// Every response is one byte longer than the previous one.
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", int(atomic.AddInt32(&hits, 1)))))
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetMaxSchedules(1)
+	if err := handler.Schedule("monitor", []string{srv.URL}, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Unschedule("monitor")
+	if err := handler.Schedule("other", []string{srv.URL}, time.Second); !errors.Is(err, ErrTooManySchedules) {
+		t.Errorf("schedule test: got error %v want %v", err, ErrTooManySchedules)
+	}
+
+	// latestSize waits for the latest results to have a size greater than min.
+	latestSize := func(min int64) int64 {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if resps, ok := handler.LatestResults("monitor"); ok && resps.Map[srv.URL].Size > min {
+				return resps.Map[srv.URL].Size
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("schedule test: results with size over %d not received", min)
+		return 0
+	}
+	first := latestSize(0)
+	latestSize(first)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schedule/monitor/results", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"`+srv.URL+`":{"size":`) {
+		t.Errorf("schedule test: unexpected results response %d %q", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schedule/unknown/results", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("schedule test: unknown schedule got status %d want %d", rec.Code, http.StatusNotFound)
+	}
+
+	if !handler.Unschedule("monitor") {
+		t.Error("schedule test: scheduled batch not found")
+	}
+	if _, ok := handler.LatestResults("monitor"); ok {
+		t.Error("schedule test: results kept after unscheduling")
+	}
+	stopped := atomic.LoadInt32(&hits)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&hits); after != stopped {
+		t.Errorf("schedule test: %d requests sent after unscheduling", after-stopped)
+	}
+	if err := handler.Schedule("other", []string{srv.URL}, time.Second); err != nil {
+		t.Errorf("schedule test: scheduling after unscheduling failed: %v", err)
+	}
+	handler.Unschedule("other")
+}
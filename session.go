@@ -0,0 +1,145 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionHeader is the request header with the ID of the session the batch belongs to.
+const SessionHeader = "X-Batch-Session"
+
+// sessionPathPrefix starts the path of the session summary endpoint, /session/{id}/summary.
+const sessionPathPrefix = "/session/"
+
+// session accumulates the summaries of the batches sent with the same session ID.
+type session struct {
+	summary  Summary
+	lastUsed time.Time
+}
+
+// sessionStore keeps the sessions until they are idle for longer than ttl.
+// When the store is full, the least recently used session is evicted.
+type sessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	max      int
+	sessions map[string]*session
+}
+
+// add merges the summary of a batch into the session, creating it if needed.
+func (ss *sessionStore) add(id string, summary Summary) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	ss.expire(now)
+	s, ok := ss.sessions[id]
+	if !ok {
+		if len(ss.sessions) >= ss.max {
+			ss.evictOldest()
+		}
+		s = &session{}
+		ss.sessions[id] = s
+	}
+	s.summary.add(summary)
+	s.lastUsed = now
+}
+
+// get returns the accumulated summary of the session.
+func (ss *sessionStore) get(id string) (Summary, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expire(time.Now())
+	s, ok := ss.sessions[id]
+	if !ok {
+		return Summary{}, false
+	}
+	return s.summary, true
+}
+
+// expire removes the sessions idle for longer than the TTL.
+func (ss *sessionStore) expire(now time.Time) {
+	for id, s := range ss.sessions {
+		if now.Sub(s.lastUsed) > ss.ttl {
+			delete(ss.sessions, id)
+		}
+	}
+}
+
+// evictOldest removes the least recently used session.
+func (ss *sessionStore) evictOldest() {
+	var oldestID string
+	var oldest time.Time
+	for id, s := range ss.sessions {
+		if oldestID == "" || s.lastUsed.Before(oldest) {
+			oldestID, oldest = id, s.lastUsed
+		}
+	}
+	delete(ss.sessions, oldestID)
+}
+
+// add merges the counters of another summary into the summary.
+func (s *Summary) add(other Summary) {
+	s.Total += other.Total
+	s.Failed += other.Failed
+	s.SLAViolations += other.SLAViolations
+	s.ServerErrors += other.ServerErrors
+	s.Lines += other.Lines
+	s.Fetched += other.Fetched
+	s.SkippedInvalid += other.SkippedInvalid
+	s.SkippedDuplicate += other.SkippedDuplicate
+	s.Denied += other.Denied
+	s.Filtered += other.Filtered
+	s.Attachments += other.Attachments
+	s.QueueWait += other.QueueWait
+}
+
+// SetSessions enables sessions accumulating the summaries of the batches sent with the same
+// X-Batch-Session header. The merged summary of a session is returned as JSON by GET /session/{id}/summary.
+// Sessions expire after being idle for ttl, and at most maxSessions are kept, evicting the least
+// recently used one. A zero ttl or maxSessions disables sessions.
+// It should be called before the handler starts serving requests.
+func (h *HTTPHandler) SetSessions(ttl time.Duration, maxSessions int) {
+	if ttl <= 0 || maxSessions <= 0 {
+		h.sessions = nil
+		return
+	}
+	h.sessions = &sessionStore{ttl: ttl, max: maxSessions, sessions: make(map[string]*session)}
+}
+
+// sessionSummaryID returns the session ID if the request is for the session summary endpoint.
+func (h *HTTPHandler) sessionSummaryID(r *http.Request) (string, bool) {
+	if h.sessions == nil || r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, sessionPathPrefix) {
+		return "", false
+	}
+	id, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, sessionPathPrefix), "/")
+	if !ok || id == "" || rest != "summary" {
+		return "", false
+	}
+	return id, true
+}
+
+// writeSessionSummary responds with the summary of the session, or 404 Not Found if it does not exist.
+func (h *HTTPHandler) writeSessionSummary(w http.ResponseWriter, id string) {
+	summary, ok := h.sessions.get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		panic(err)
+	}
+}
+
+// recordSession merges the summary of the batch into its session, if it has one.
+func (h *HTTPHandler) recordSession(r *http.Request, resps *ResponseMap) {
+	if h.sessions == nil {
+		return
+	}
+	if id := r.Header.Get(SessionHeader); id != "" {
+		h.sessions.add(id, resps.Summary())
+	}
+}
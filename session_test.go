@@ -0,0 +1,69 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerSessions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	handler := NewHTTPHandler()
+	handler.SetSessions(200*time.Millisecond, 10)
+	for _, body := range []string{
+		srv.URL + "/a\n" + srv.URL + "/b",
+		srv.URL + "/c\nhttp://127.0.0.1:1",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(SessionHeader, "s1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/session/s1/summary", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("sessions test: handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var summary Summary
+	if err := json.NewDecoder(rr.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Total != 4 || summary.Failed != 1 || summary.Fetched != 4 {
+		t.Errorf("sessions test: unexpected summary %+v", summary)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/session/unknown/summary", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("sessions test: unknown session: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/session/s1/summary", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("sessions test: expired session: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestSessionStoreEviction(t *testing.T) {
+	store := &sessionStore{ttl: time.Hour, max: 2, sessions: make(map[string]*session)}
+	store.add("a", Summary{Total: 1})
+	store.add("b", Summary{Total: 1})
+	store.add("a", Summary{Total: 1})
+	store.add("c", Summary{Total: 1})
+	if _, ok := store.get("b"); ok {
+		t.Error("session eviction test: least recently used session was kept")
+	}
+	if summary, ok := store.get("a"); !ok || summary.Total != 2 {
+		t.Errorf("session eviction test: got session a %+v, %v want 2 responses", summary, ok)
+	}
+}
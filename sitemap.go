@@ -0,0 +1,78 @@
+package httphandler
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// sitemapMediaTypes are the media types of the request bodies parsed as sitemaps.
+var sitemapMediaTypes = map[string]bool{
+	"application/xml": true,
+	"text/xml":        true,
+}
+
+// sitemapPrefix starts the request bodies sniffed as sitemaps, e.g. "<?xml" or "<urlset".
+const sitemapPrefix = '<'
+
+// isSitemap reports whether the URL list is a sitemap, either by the media type of the request body
+// or by the first character of the list.
+func isSitemap(contentType string, reader *bufio.Reader) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && sitemapMediaTypes[mediaType] {
+		return true
+	}
+	first, err := reader.Peek(1)
+	return err == nil && first[0] == sitemapPrefix
+}
+
+// newURLSource returns the source of URLs in the list, parsed as a sitemap or line by line.
+func newURLSource(contentType string, reader *bufio.Reader) urlSource {
+	if isSitemap(contentType, reader) {
+		return &sitemapSource{dec: xml.NewDecoder(reader)}
+	}
+	return bufio.NewScanner(reader)
+}
+
+// sitemapSource yields the URLs of the <loc> elements of a sitemap as they are decoded,
+// so that large sitemaps are not loaded into memory as a whole.
+type sitemapSource struct {
+	dec *xml.Decoder
+	loc string
+	err error
+}
+
+func (ss *sitemapSource) Scan() bool {
+	for ss.err == nil {
+		token, err := ss.dec.Token()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			ss.err = fmt.Errorf("invalid sitemap: %w", err)
+			return false
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "loc" {
+			continue
+		}
+		var loc string
+		if err = ss.dec.DecodeElement(&loc, &start); err != nil {
+			ss.err = fmt.Errorf("invalid sitemap: %w", err)
+			return false
+		}
+		ss.loc = strings.TrimSpace(loc)
+		return true
+	}
+	return false
+}
+
+func (ss *sitemapSource) Text() string {
+	return ss.loc
+}
+
+func (ss *sitemapSource) Err() error {
+	return ss.err
+}
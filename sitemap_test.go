@@ -0,0 +1,66 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPHandlerSitemap(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("page"))
+	}))
+	defer srv.Close()
+	sitemap := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>` + srv.URL + `/a</loc><lastmod>2024-01-01</lastmod></url>
+  <url>
+    <loc>
+      ` + srv.URL + `/b
+    </loc>
+  </url>
+</urlset>`
+
+	for _, tt := range []struct {
+		contentType string
+		body        string
+		respCode    int
+		paths       []string
+	}{
+		{contentType: "application/xml; charset=utf-8", body: sitemap, respCode: http.StatusOK, paths: []string{"/a", "/b"}},
+		// The sitemap is sniffed by its first character.
+		{body: sitemap, respCode: http.StatusOK, paths: []string{"/a", "/b"}},
+		{body: `<urlset><url><loc>` + srv.URL + `/a</loc></url>`, respCode: http.StatusBadRequest},
+		{contentType: "text/xml", body: srv.URL + "/a", respCode: http.StatusBadRequest},
+	} {
+		paths = nil
+		handler := NewHTTPHandler()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.respCode {
+			t.Errorf("sitemap test %q: handler returned wrong status code: got %v want %v", tt.contentType, rr.Code, tt.respCode)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		mu.Lock()
+		sort.Strings(paths)
+		if strings.Join(paths, " ") != strings.Join(tt.paths, " ") {
+			t.Errorf("sitemap test %q: fetched %v want %v", tt.contentType, paths, tt.paths)
+		}
+		mu.Unlock()
+		if body := rr.Body.String(); body != "4\n4\n" {
+			t.Errorf("sitemap test %q: got sizes %q", tt.contentType, body)
+		}
+	}
+}
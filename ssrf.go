@@ -0,0 +1,78 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrBlockedAddress is recorded when a URL resolves to a private, loopback or link-local address
+// and such addresses are blocked.
+var ErrBlockedAddress = errors.New("address is blocked")
+
+// blockedIP reports whether the IP address is private, loopback, link-local or unspecified.
+func blockedIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkAddress returns ErrBlockedAddress if the network address has a blocked IP.
+func checkAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+// SetBlockPrivateAddresses sets whether the requests to private, loopback and link-local addresses,
+// like 127.0.0.1, 10.0.0.1 or 169.254.169.254, fail with ErrBlockedAddress, to guard against
+// server-side request forgery. The address is checked after the host name is resolved, right before
+// connecting, so a host name cannot be rebound to a blocked address after the check. If the transport
+// dials through a custom function, the host name is resolved by the handler and the function is given
+// the checked addresses instead. Requests sent through a proxy are checked against the address of the proxy.
+// It requires the client transport to be an *http.Transport and should be called before the handler
+// starts serving requests.
+func (h *HTTPHandler) SetBlockPrivateAddresses(enabled bool) error {
+	if !enabled {
+		return h.setTransportOption(optBlockPrivate, nil)
+	}
+	return h.setTransportOption(optBlockPrivate, h.blockPrivateAddresses)
+}
+
+// blockPrivateAddresses makes the transport refuse to connect to the blocked addresses.
+func (h *HTTPHandler) blockPrivateAddresses(transport *http.Transport, dialer *net.Dialer) {
+	dial := transport.DialContext
+	if dial == nil {
+		checked := *dialer
+		checked.Control = func(network, address string, _ syscall.RawConn) error {
+			return checkAddress(address)
+		}
+		transport.DialContext = checked.DialContext
+		return
+	}
+	// A custom dial function cannot be given the Control hook, so it only dials the checked addresses.
+	resolver := h.lookupResolver()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if blockedIP(ip.IP) {
+				return nil, fmt.Errorf("%w: %s", ErrBlockedAddress, ip.IP)
+			}
+		}
+		return dialAddresses(ctx, dial, network, host, port, ips)
+	}
+}
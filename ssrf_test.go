@@ -0,0 +1,104 @@
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPHandlerBlockPrivateAddresses(t *testing.T) {
+	// A bare listener tells whether a connection was opened at all, not only whether a request was sent.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	serverURL := "http://" + listener.Addr().String() + "/"
+	// The host name only resolves to the loopback address at dial time.
+	hostURL := strings.Replace(serverURL, "127.0.0.1", "localhost", 1)
+
+	for _, tt := range []struct {
+		name   string
+		client *http.Client
+	}{
+		{name: "default transport", client: http.DefaultClient},
+		{name: "custom dial", client: &http.Client{Transport: &http.Transport{
+			DialContext: (&net.Dialer{}).DialContext,
+		}}},
+	} {
+		handler := NewHTTPHandler()
+		if err := handler.SetBlockPrivateAddresses(true); err != nil {
+			t.Fatal(err)
+		}
+		// The guard does not depend on the order of the calls.
+		if err := handler.SetClient(tt.client); err != nil {
+			t.Fatal(err)
+		}
+		resps, err := handler.Fetch(context.Background(), []string{serverURL, hostURL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, urlString := range []string{serverURL, hostURL} {
+			if resp := resps.Map[urlString]; !errors.Is(resp.Error, ErrBlockedAddress) {
+				t.Errorf("block private addresses test %s: %s got error %v want %v", tt.name, urlString, resp.Error, ErrBlockedAddress)
+			}
+		}
+		if n := atomic.LoadInt32(&accepted); n != 0 {
+			t.Errorf("block private addresses test %s: got %d connections want none", tt.name, n)
+		}
+	}
+
+	handler := NewHTTPHandler()
+	if err := handler.SetBlockPrivateAddresses(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SetBlockPrivateAddresses(false); err != nil {
+		t.Fatal(err)
+	}
+	resps, err := handler.Fetch(context.Background(), []string{serverURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := resps.Map[serverURL]; errors.Is(resp.Error, ErrBlockedAddress) {
+		t.Errorf("block private addresses test: disabled guard got error %v want the address allowed", resp.Error)
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"8.8.8.8", false},
+		{"2606:4700::1111", false},
+	} {
+		if got := blockedIP(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("blocked IP test: %s got blocked %v want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package httphandler
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrTLSFailure is recorded when the TLS handshake with the server fails,
+// e.g. because no allowed cipher suite could be negotiated.
+var ErrTLSFailure = errors.New("TLS handshake failure")
+
+// configureTLS records the transport option i modifying the TLS configuration of the transport with configure.
+func (h *HTTPHandler) configureTLS(i int, configure func(*tls.Config)) error {
+	return h.setTransportOption(i, func(transport *http.Transport, _ *net.Dialer) {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		configure(transport.TLSClientConfig)
+	})
+}
+
+// SetTLSCipherSuites restricts the cipher suites the client offers, so that the connections to servers
+// supporting none of them fail with ErrTLSFailure. Go does not allow configuring the TLS 1.3 cipher suites,
+// so the restriction only applies to connections negotiating TLS 1.2 or lower.
+// It requires the client transport to be an *http.Transport and should be called before the handler
+// starts serving requests.
+func (h *HTTPHandler) SetTLSCipherSuites(suites []uint16) error {
+	known := make(map[uint16]bool)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.ID] = true
+	}
+	for _, suite := range suites {
+		if !known[suite] {
+			return fmt.Errorf("unknown cipher suite %#04x", suite)
+		}
+	}
+	return h.configureTLS(optCipherSuites, func(config *tls.Config) {
+		config.CipherSuites = append([]uint16(nil), suites...)
+	})
+}
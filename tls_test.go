@@ -0,0 +1,108 @@
+package httphandler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerTLSCipherSuites(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	srv.TLS = &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name  string
+		suite uint16
+		ok    bool
+	}{
+		{name: "allowed", suite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ok: true},
+		{name: "disallowed", suite: tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, ok: false},
+	} {
+		handler := NewHTTPHandler()
+		// The client of the test server trusts its certificate.
+		handler.SetClient(srv.Client())
+		if err := handler.SetTLSCipherSuites([]uint16{tt.suite}); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(srv.URL))
+		resps, err := handler.executeAllRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := resps.Map[srv.URL]
+		if tt.ok && resp.Error != nil {
+			t.Errorf("cipher suites test %s: unexpected error %v", tt.name, resp.Error)
+		}
+		if !tt.ok && !errors.Is(resp.Error, ErrTLSFailure) {
+			t.Errorf("cipher suites test %s: got error %v want %v", tt.name, resp.Error, ErrTLSFailure)
+		}
+	}
+
+	if err := NewHTTPHandler().SetTLSCipherSuites([]uint16{0xffff}); err == nil {
+		t.Error("cipher suites test: unknown cipher suite unexpectedly accepted")
+	}
+}
+
+func TestHTTPHandlerUntrustedCertificate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	// The default client does not trust the certificate of the test server.
+	resps, err := NewHTTPHandler().Fetch(context.Background(), []string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := resps.Map[srv.URL]
+	if !errors.Is(resp.Error, ErrTLSFailure) {
+		t.Errorf("untrusted certificate test: got error %v want %v", resp.Error, ErrTLSFailure)
+	}
+	var urlErr *url.Error
+	if !errors.As(resp.Error, &urlErr) {
+		t.Errorf("untrusted certificate test: error %v does not wrap the transport error", resp.Error)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "EOF", err: &url.Error{Op: "Get", URL: "http://a", Err: io.EOF}, want: ErrEmptyResponse},
+		{name: "unknown authority", err: &url.Error{Op: "Get", URL: "https://a", Err: x509.UnknownAuthorityError{}}, want: ErrTLSFailure},
+		{name: "hostname", err: &url.Error{Op: "Get", URL: "https://a", Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "a"}}, want: ErrTLSFailure},
+		{name: "alert", err: &net.OpError{Op: "remote error", Err: errors.New("handshake failure")}, want: ErrTLSFailure},
+		{name: "plain http", err: errors.New("http: server gave HTTP response to HTTPS client"), want: ErrTLSFailure},
+		// Mentioning TLS is not enough to be classified as a TLS failure.
+		{name: "tls in message", err: errors.New("dial tcp: lookup tls: no such host"), want: nil},
+		{name: "refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: nil},
+	} {
+		got := classifyError(tt.err)
+		if !errors.Is(got, tt.err) {
+			t.Errorf("classify error test %s: got %v which does not wrap %v", tt.name, got, tt.err)
+		}
+		for _, class := range []error{ErrEmptyResponse, ErrTLSFailure, ErrUnsupportedTransferEncoding} {
+			if is := errors.Is(got, class); is != (class == tt.want) {
+				t.Errorf("classify error test %s: got errors.Is %v for %v want %v", tt.name, is, class, class == tt.want)
+			}
+		}
+	}
+}
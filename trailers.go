@@ -0,0 +1,56 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Trailers sent after the body of the batch response if enabled.
+const (
+	verdictTrailer = "X-Batch-Verdict"
+	summaryTrailer = "X-Batch-Summary"
+)
+
+// SetSummaryTrailers sets whether the final verdict and the summary of the batch are sent in the trailers
+// after the body, so that the clients reading the results as they are streamed still get them reliably.
+// The X-Batch-Verdict trailer is "complete" if all the requests have succeeded and "partial" otherwise,
+// and X-Batch-Summary lists the counters of the batch, e.g. "total=3, failed=1, sla-violations=0, server-errors=0",
+// followed by the breakdown of the listed URLs, e.g. "lines=4, fetched=3, skipped-invalid=0, skipped-duplicate=1,
+// denied=0, filtered=0".
+// HTTP/1.0 clients do not support trailers, so they receive them as headers of the buffered response.
+func (h *HTTPHandler) SetSummaryTrailers(enabled bool) {
+	h.trailers = enabled
+}
+
+// declareTrailers announces the summary trailers in the Trailer header, if they are enabled.
+func (h *HTTPHandler) declareTrailers(w http.ResponseWriter) {
+	if h.trailers {
+		w.Header().Set("Trailer", verdictTrailer+", "+summaryTrailer)
+	}
+}
+
+// writeTrailers sets the summary trailers, if they are enabled. It must be called after the body is written.
+func (h *HTTPHandler) writeTrailers(w http.ResponseWriter, resps *ResponseMap, status int) {
+	if !h.trailers {
+		return
+	}
+	verdict := "partial"
+	if status == http.StatusOK {
+		verdict = "complete"
+	}
+	summary := resps.Summary()
+	w.Header().Set(verdictTrailer, verdict)
+	w.Header().Set(summaryTrailer, strings.Join([]string{
+		fmt.Sprintf("total=%d", summary.Total),
+		fmt.Sprintf("failed=%d", summary.Failed),
+		fmt.Sprintf("sla-violations=%d", summary.SLAViolations),
+		fmt.Sprintf("server-errors=%d", summary.ServerErrors),
+		fmt.Sprintf("lines=%d", summary.Lines),
+		fmt.Sprintf("fetched=%d", summary.Fetched),
+		fmt.Sprintf("skipped-invalid=%d", summary.SkippedInvalid),
+		fmt.Sprintf("skipped-duplicate=%d", summary.SkippedDuplicate),
+		fmt.Sprintf("denied=%d", summary.Denied),
+		fmt.Sprintf("filtered=%d", summary.Filtered),
+	}, ", "))
+}
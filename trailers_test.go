@@ -0,0 +1,55 @@
+package httphandler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandlerSummaryTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+	const failedURL = "http://127.0.0.1:1"
+
+	handler := NewHTTPHandler()
+	handler.SetSummaryTrailers(true)
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		body    string
+		verdict string
+		summary string
+	}{
+		{body: upstream.URL, verdict: "complete", summary: "total=1, failed=0, sla-violations=0, server-errors=0, " +
+			"lines=1, fetched=1, skipped-invalid=0, skipped-duplicate=0, denied=0, filtered=0"},
+		{body: upstream.URL + "\n" + failedURL, verdict: "partial", summary: "total=2, failed=1, sla-violations=0, server-errors=0, " +
+			"lines=2, fetched=2, skipped-invalid=0, skipped-duplicate=0, denied=0, filtered=0"},
+	} {
+		resp, err := srv.Client().Post(srv.URL, "text/plain", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("trailers test: got protocol %s want HTTP/2", resp.Proto)
+		}
+		// The trailers are only available once the body has been read.
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Trailer.Get(verdictTrailer); got != tt.verdict {
+			t.Errorf("trailers test: got verdict %q want %q", got, tt.verdict)
+		}
+		if got := resp.Trailer.Get(summaryTrailer); got != tt.summary {
+			t.Errorf("trailers test: got summary %q want %q", got, tt.summary)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// transportOption modifies the transport of the client set with SetClient. dialer is the dialer
+// the transport connects with while its DialContext is nil.
+type transportOption func(transport *http.Transport, dialer *net.Dialer)
+
+// The transport options in the order they are applied. The options wrapping the dialer wrap
+// the ones applied before them, so that the addresses are checked right before connecting and
+// the connections are counted as they are returned to the transport.
+const (
+	optBlockPrivate = iota
+	optDNSTimeout
+	optOpenConns
+	optCountWire
+	optPinnedCerts
+	optCipherSuites
+	numTransportOptions
+)
+
+// setTransportOption records the transport option, nil removing it, and applies the recorded options
+// to the client set with SetClient. The option is not recorded if it cannot be applied.
+func (h *HTTPHandler) setTransportOption(i int, option transportOption) error {
+	prev := h.transportOpts[i]
+	h.transportOpts[i] = option
+	if err := h.applyClient(h.baseClient); err != nil {
+		h.transportOpts[i] = prev
+		return err
+	}
+	return nil
+}
+
+// applyClient sets the client the requests are sent with to a copy of base with the recorded
+// transport options applied, or to base itself if there are none.
+func (h *HTTPHandler) applyClient(base *http.Client) error {
+	var options []transportOption
+	for _, option := range h.transportOpts {
+		if option != nil {
+			options = append(options, option)
+		}
+	}
+	if len(options) == 0 {
+		h.baseClient, h.client = base, base
+		return nil
+	}
+	transport, ok := transportOf(base).(*http.Transport)
+	if !ok {
+		return fmt.Errorf("transport options require *http.Transport, got %T", transportOf(base))
+	}
+	dialer := &net.Dialer{}
+	if transport == http.DefaultTransport {
+		// The dialer of http.DefaultTransport, which cannot be extracted from its DialContext.
+		dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport = transport.Clone()
+		transport.DialContext = nil
+	} else {
+		transport = transport.Clone()
+	}
+	for _, option := range options {
+		option(transport, dialer)
+	}
+	client := *base
+	client.Transport = transport
+	h.baseClient, h.client = base, &client
+	return nil
+}
+
+// dialOf returns the function the transport dials with.
+func dialOf(transport *http.Transport, dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if transport.DialContext != nil {
+		return transport.DialContext
+	}
+	return dialer.DialContext
+}